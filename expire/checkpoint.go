@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package expire
+
+import "io/ioutil"
+import "os"
+
+/*
+Stores the progress of an expire run.
+*/
+type Checkpoint interface {
+	// Returns the saved continuation key or nil, if there is none.
+	Load() (cont []byte, err error)
+	
+	// Saves the continuation key. nil clears the checkpoint.
+	Save(cont []byte) error
+}
+
+/*
+A Checkpoint stored in a file.
+*/
+type FileCheckpoint struct {
+	Path string
+}
+
+var _ Checkpoint = (*FileCheckpoint)(nil)
+
+func (f *FileCheckpoint) Load() (cont []byte, err error) {
+	cont,err = ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) { return nil,nil }
+	if len(cont)==0 { cont = nil }
+	return
+}
+
+func (f *FileCheckpoint) Save(cont []byte) (err error) {
+	if cont==nil {
+		err = os.Remove(f.Path)
+		if os.IsNotExist(err) { err = nil }
+		return
+	}
+	
+	/* Write-and-rename, so a crash never leaves a partial checkpoint. */
+	tmp := f.Path+".tmp"
+	err = ioutil.WriteFile(tmp,cont,0600)
+	if err==nil { err = os.Rename(tmp,f.Path) }
+	return
+}
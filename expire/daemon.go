@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package expire
+
+import "context"
+import "sync"
+import "sync/atomic"
+import "time"
+
+/*
+A time-based rate limiter. Allows at most Rate events per second.
+*/
+type limiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(rate int) *limiter {
+	if rate<=0 { return nil }
+	return &limiter{interval: time.Second/time.Duration(rate)}
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if err := ctx.Err(); err!=nil { return err }
+	now := time.Now()
+	if l.next.Before(now) { l.next = now }
+	d := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	if d<=0 { return nil }
+	
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C: return nil
+	case <-ctx.Done(): return ctx.Err()
+	}
+}
+
+/*
+A snapshot of the state of a Daemon.
+*/
+type Progress struct {
+	// True, if a run is in progress.
+	Running bool
+	
+	// Start of the current run (or the last run, if not Running).
+	Started time.Time
+	
+	// Articles deleted by the current run (or the last run, if not Running).
+	Deleted int64
+	
+	// The expiry time, up to which all articles have been processed.
+	LastExpiry time.Time
+	
+	// The report and error of the last finished run.
+	Last      *Report
+	LastError error
+}
+
+/*
+A long-running expire service. Runs the Expirer every Interval.
+*/
+type Daemon struct {
+	Expirer *Expirer
+	
+	// Time between two runs. If zero, one hour is assumed.
+	Interval time.Duration
+	
+	// Maximum number of articles deleted per second. If zero, the rate is unlimited.
+	Rate int
+	
+	// If not nil, the last processed expiry time is persisted here.
+	State Checkpoint
+	
+	mu      sync.Mutex
+	prog    Progress
+	deleted int64
+}
+
+func (d *Daemon) interval() time.Duration {
+	if d.Interval<=0 { return time.Hour }
+	return d.Interval
+}
+
+// Returns the progress of the daemon.
+func (d *Daemon) Progress() (p Progress) {
+	d.mu.Lock()
+	p = d.prog
+	d.mu.Unlock()
+	p.Deleted = atomic.LoadInt64(&d.deleted)
+	return
+}
+
+func (d *Daemon) loadState() (err error) {
+	if d.State==nil { return }
+	var buf []byte
+	buf,err = d.State.Load()
+	if err!=nil || buf==nil { return }
+	var t time.Time
+	err = t.UnmarshalText(buf)
+	if err!=nil { return }
+	d.mu.Lock()
+	d.prog.LastExpiry = t
+	d.mu.Unlock()
+	return
+}
+
+func (d *Daemon) saveState(t time.Time) (err error) {
+	if d.State==nil { return }
+	var buf []byte
+	buf,err = t.MarshalText()
+	if err==nil { err = d.State.Save(buf) }
+	return
+}
+
+/*
+Performs one expire run.
+*/
+func (d *Daemon) RunOnce(ctx context.Context) (rep *Report, err error) {
+	now := time.Now()
+	lim := newLimiter(d.Rate)
+	
+	e := *d.Expirer
+	e.Throttle = func(ctx context.Context) error {
+		if lim!=nil {
+			if err := lim.wait(ctx); err!=nil { return err }
+		} else if err := ctx.Err(); err!=nil {
+			return err
+		}
+		atomic.AddInt64(&d.deleted,1)
+		return nil
+	}
+	
+	d.mu.Lock()
+	d.prog.Running = true
+	d.prog.Started = now
+	d.mu.Unlock()
+	atomic.StoreInt64(&d.deleted,0)
+	
+	rep,err = e.ExpireReport(ctx,&now,false)
+	if err==nil { err = d.saveState(now) }
+	
+	d.mu.Lock()
+	d.prog.Running = false
+	d.prog.Last = rep
+	d.prog.LastError = err
+	if err==nil { d.prog.LastExpiry = now }
+	d.mu.Unlock()
+	return
+}
+
+/*
+Runs the Expirer every Interval, until ctx is cancelled. If the last run
+(as persisted in State) is longer ago than Interval, the first run starts immediately.
+*/
+func (d *Daemon) Run(ctx context.Context) (err error) {
+	err = d.loadState()
+	if err!=nil { return }
+	
+	last := d.Progress().LastExpiry
+	for {
+		if wait := time.Until(last.Add(d.interval())); wait>0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+		
+		/* A failed run is retried after Interval. */
+		last = time.Now()
+		d.RunOnce(ctx)
+		if err = ctx.Err(); err!=nil { return }
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package expire
+
+import (
+	"github.com/byte-mug/fastnntp"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const day = time.Hour*24
+
+// Retention, that never expires.
+const Never time.Duration = -1
+
+type ModFlag byte
+const (
+	Mod_All         ModFlag = 'A'
+	Mod_Moderated   ModFlag = 'M'
+	Mod_Unmoderated ModFlag = 'U'
+)
+
+/*
+A retention rule, as found in INN's expire.ctl:
+
+	<pattern>:<modflag>:<keep>:<default>:<purge>
+
+Keep, Default and Purge are given in days; "never" means, that the articles
+never expire.
+*/
+type Rule struct {
+	Pattern string
+	Mod     ModFlag
+	
+	// Articles are kept at least Keep, and at most Purge.
+	Keep, Default, Purge time.Duration
+	
+	wm *fastnntp.WildMat
+}
+
+func (r *Rule) match(grp []byte, moderated bool) bool {
+	switch r.Mod {
+	case Mod_Moderated: if !moderated { return false }
+	case Mod_Unmoderated: if moderated { return false }
+	}
+	return r.wm.Match(grp)
+}
+
+/*
+Computes the expiry time of an article in a group matching this rule.
+The zero time means, that the article never expires.
+*/
+func (r *Rule) expires(arrival, hdr time.Time) time.Time {
+	if hdr.IsZero() {
+		if r.Default==Never { return time.Time{} }
+		return arrival.Add(r.Default)
+	}
+	if r.Keep==Never { return time.Time{} }
+	if min := arrival.Add(r.Keep); hdr.Before(min) { return min }
+	if r.Purge!=Never {
+		if max := arrival.Add(r.Purge); hdr.After(max) { return max }
+	}
+	return hdr
+}
+
+// Used, if no rule matches.
+var defaultRule = &Rule{Pattern: "*", Mod: Mod_All, Keep: 0, Default: day, Purge: day}
+
+/*
+Per-group retention policy, modelled after INN's expire.ctl.
+*/
+type Policy struct {
+	// If multiple rules match a group, the last one wins.
+	Rules []*Rule
+	
+	// How long the Message-IDs of expired or rejected articles are remembered (/remember/).
+	Remember time.Duration
+}
+
+func parseDays(s string) (time.Duration,error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s,"never") { return Never,nil }
+	f,err := strconv.ParseFloat(s,64)
+	if err!=nil { return 0,err }
+	if f<0 { return 0,fmt.Errorf("negative number of days: %q",s) }
+	return time.Duration(f*float64(day)),nil
+}
+
+/*
+Parses an expire.ctl style file.
+*/
+func ParseExpireCtl(r io.Reader) (p *Policy, err error) {
+	p = new(Policy)
+	sc := bufio.NewScanner(r)
+	lno := 0
+	for sc.Scan() {
+		lno++
+		line := sc.Text()
+		if i := strings.IndexByte(line,'#'); i>=0 { line = line[:i] }
+		line = strings.TrimSpace(line)
+		if line=="" { continue }
+		
+		f := strings.Split(line,":")
+		if len(f)==2 && f[0]=="/remember/" {
+			p.Remember,err = parseDays(f[1])
+			if err!=nil { return nil,fmt.Errorf("expire.ctl:%d: %v",lno,err) }
+			continue
+		}
+		if len(f)!=5 { return nil,fmt.Errorf("expire.ctl:%d: expected 5 fields",lno) }
+		
+		ru := &Rule{Pattern: f[0]}
+		switch m := strings.ToUpper(strings.TrimSpace(f[1])); m {
+		case "A","M","U": ru.Mod = ModFlag(m[0])
+		default: return nil,fmt.Errorf("expire.ctl:%d: bad modflag %q",lno,f[1])
+		}
+		if ru.Keep,err = parseDays(f[2]); err!=nil { return nil,fmt.Errorf("expire.ctl:%d: %v",lno,err) }
+		if ru.Default,err = parseDays(f[3]); err!=nil { return nil,fmt.Errorf("expire.ctl:%d: %v",lno,err) }
+		if ru.Purge,err = parseDays(f[4]); err!=nil { return nil,fmt.Errorf("expire.ctl:%d: %v",lno,err) }
+		
+		ru.wm = fastnntp.ParseWildMat(ru.Pattern)
+		if err = ru.wm.Compile(); err!=nil { return nil,fmt.Errorf("expire.ctl:%d: %v",lno,err) }
+		
+		p.Rules = append(p.Rules,ru)
+	}
+	err = sc.Err()
+	if err!=nil { p = nil }
+	return
+}
+
+/*
+Loads an expire.ctl style file.
+*/
+func LoadExpireCtl(path string) (*Policy,error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return ParseExpireCtl(f)
+}
+
+func (p *Policy) rule(grp []byte, moderated bool) *Rule {
+	for i := len(p.Rules)-1; i>=0; i-- {
+		if p.Rules[i].match(grp,moderated) { return p.Rules[i] }
+	}
+	return defaultRule
+}
+
+/*
+Computes the expiry time of an article. hdr is the content of the article's
+Expires: header or the zero time, if absent. moderated may be nil.
+
+Crossposted articles take the longest retention of their groups. The zero time
+means, that the article never expires.
+*/
+func (p *Policy) Expires(arrival, hdr time.Time, grps [][]byte, moderated func(grp []byte) bool) (exp time.Time) {
+	for i,grp := range grps {
+		mod := false
+		if moderated!=nil { mod = moderated(grp) }
+		e := p.rule(grp,mod).expires(arrival,hdr)
+		if e.IsZero() { return e }
+		if i==0 || e.After(exp) { exp = e }
+	}
+	return
+}
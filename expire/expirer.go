@@ -37,8 +37,44 @@ type Expirer struct{
 	OV  storage.OverviewMethod
 	HIS storage.HisMethod
 	RI  storage.RiMethod
+	
+	// If not nil, the progress of ExpireProcess is saved, so an interrupted run can be resumed.
+	Checkpoint Checkpoint
+	
+	// If not nil, Throttle is called once per expired article, before it is deleted. It may block
+	// to limit the deletion rate. If it returns an error, the run is aborted.
+	Throttle func(ctx context.Context) error
+	
+	// If not zero, deleted articles leave a tombstone in the history, so they are not accepted again.
+	// If Never, the tombstones never expire.
+	Remember time.Duration
 }
 
+// Removes an article from the history, leaving a tombstone, if configured.
+func (e *Expirer) hisForget(msgid []byte) error {
+	switch {
+	case e.Remember==Never: return e.HIS.HisRemember(msgid,time.Time{})
+	case e.Remember>0: return e.HIS.HisRemember(msgid,time.Now().Add(e.Remember))
+	}
+	return e.HIS.HisCancel(msgid)
+}
+
+/*
+Called before each deletion. Throttle is only called before the first deletion
+of an article; started reports, whether the article has been started already.
+*/
+func (e *Expirer) step(ctx context.Context, started *bool) error {
+	if e.Throttle!=nil && !*started {
+		*started = true
+		return e.Throttle(ctx)
+	}
+	*started = true
+	return ctx.Err()
+}
+
+// The number of expired articles between two checkpoints.
+const checkpoint_interval = 256
+
 
 /*
 Expires old articles.
@@ -46,45 +82,125 @@ Expires old articles.
 ow = NOW.
 */
 func(e *Expirer) ExpireProcess(ctx context.Context, ow *time.Time) error {
-	if e.RI==nil && ow==nil { return ECouldNotQuery }
+	_,err := e.ExpireReport(ctx,ow,false)
+	return err
+}
+
+/*
+Expires old articles and reports statistics. If dryRun is true, nothing is
+deleted and the checkpoint is left untouched.
+
+ow = NOW.
+*/
+func(e *Expirer) ExpireReport(ctx context.Context, ow *time.Time, dryRun bool) (rep *Report, err error) {
+	rep = newReport(dryRun)
+	defer rep.finish()
+	
+	if e.RI==nil || ow==nil { return rep,ECouldNotQuery }
 	
 	hist := new(storage.RiHistory)
 	tok := new(storage.TOKEN)
 	ove := new(storage.OverviewElement)
 	
-	cur,err := e.RI.RiQueryExpired(ow,hist)
-	if err!=nil { return err }
+	chk := e.Checkpoint
+	if dryRun { chk = nil }
+	
+	var cont []byte
+	if chk!=nil {
+		cont,err = chk.Load()
+		if err!=nil { return }
+	}
+	
+	to := ow.Add(time.Second)
+	cur,err := e.RI.RiQueryExpiredRange(nil,&to,cont,hist)
+	if err!=nil { return }
 	defer cur.Release()
 	
+	n := 0
 	hasNoTok := true
+	started := false
+	var lng int64
+	var last []byte /* Continuation of the last completed article. */
 	for cur.Next() {
-		if hist.Group!=nil && e.OV!=nil {
-			if hasNoTok {
+		if hist.Group!=nil {
+			gs := rep.group(hist.Group)
+			gs.Articles++
+			if e.OV!=nil {
 				if rel,err := e.OV.FetchOne(hist.Group,hist.Num,tok,ove); err==nil {
 					hasNoTok = false
+					lng = ove.Lng
+					gs.Bytes += ove.Lng
 					if rel!=nil { rel.Release() }
 				}
+				if !dryRun {
+					/*
+					The article is only partially deleted. Its RI record is still intact,
+					so a resumed run will process it again.
+					*/
+					if err = e.step(ctx,&started); err!=nil {
+						if chk!=nil && last!=nil { chk.Save(last) }
+						return
+					}
+					rep.OV.add(e.OV.CancelOv(hist.Group,hist.Num))
+				}
 			}
-			e.OV.CancelOv(hist.Group,hist.Num)
 		}
-		if hist.MessageId!=nil && e.HIS!=nil {
-			if hasNoTok {
+		if hist.MessageId!=nil {
+			if hasNoTok && e.HIS!=nil {
 				if e.HIS.HisLookup(hist.MessageId,tok)==nil {
 					hasNoTok = false
 				}
 			}
-			e.HIS.HisCancel(hist.MessageId)
-			e.RI.RiExpire(hist.MessageId)
-			if !hasNoTok && e.SM!=nil {
-				e.SM.Cancel(tok)
+			if !dryRun {
+				if err = e.step(ctx,&started); err!=nil {
+					if chk!=nil && last!=nil { chk.Save(last) }
+					return
+				}
+			}
+			rep.Articles++
+			rep.Bytes += lng
+			if !dryRun {
+				if e.HIS!=nil { rep.HIS.add(e.hisForget(hist.MessageId)) }
+				rep.RI.add(e.RI.RiExpire(hist.MessageId))
+				if !hasNoTok && e.SM!=nil {
+					rep.SM.add(e.SM.Cancel(tok))
+				}
 			}
 			hasNoTok = true
+			started = false
+			lng = 0
+			
+			n++
+			if chk!=nil {
+				last = cur.Continuation()
+				if n%checkpoint_interval==0 { chk.Save(last) }
+			}
 			
-			// We receive a cancellation signal only after the whole article has been deleted.
-			if err = ctx.Err(); err!=nil { return err }
+			if err = ctx.Err(); err!=nil {
+				if chk!=nil { chk.Save(last) }
+				return
+			}
 		}
 	}
-	return nil
+	
+	/* The run is complete. The next run starts from the beginning. */
+	if chk!=nil { err = chk.Save(nil) }
+	
+	if e.HIS!=nil && !dryRun {
+		var terr error
+		rep.Tombstones,terr = e.HIS.HisExpireRemembered(*ow)
+		rep.HIS.add(terr)
+	}
+	return
+}
+
+/*
+Drops the history entries of articles, that arrived more than age ago.
+age should exceed the longest retention time, otherwise stored articles lose their entries.
+*/
+func(e *Expirer) PurgeHistory(age time.Duration) (n int64, err error) {
+	if e.HIS==nil { return 0,ECouldNotQuery }
+	return e.HIS.HisPurge(time.Now().Add(-age))
 }
 
 // Deletes an article based on it's Message-ID. Will remove it from storage and all groups that contain it.
@@ -116,7 +232,7 @@ func(e *Expirer) CancelMessageId(msgid []byte) error {
 				hasNoTok = false
 			}
 		}
-		e.HIS.HisCancel(msgid)
+		e.hisForget(msgid)
 	}
 	e.RI.RiExpire(msgid)
 	if !hasNoTok && e.SM!=nil {
@@ -134,9 +250,9 @@ func(e *Expirer) CancelGroupNum(group []byte, num int64) error {
 	
 	msgid := make([]byte,0,128)
 	
-	hasNoTok := true
+	if e.OV==nil { return ECouldNotQuery }
 	{
-		rel,err := e.OV.FetchOne(rie.Group,rie.Num,tok,ove)
+		rel,err := e.OV.FetchOne(group,num,tok,ove)
 		if err==nil { msgid = append(msgid[:0],ove.MsgId...) }
 		if rel!=nil { rel.Release() }
 		if err!=nil { return err }
@@ -152,7 +268,7 @@ func(e *Expirer) CancelGroupNum(group []byte, num int64) error {
 		}
 	}
 	if e.HIS!=nil {
-		e.HIS.HisCancel(msgid)
+		e.hisForget(msgid)
 	}
 	e.RI.RiExpire(msgid)
 	
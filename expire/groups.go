@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package expire
+
+import "github.com/byte-mug/fastnntp-backend2/storage"
+import "math"
+import "fmt"
+
+/*
+Rewrites the reverse index entries of all articles in the group src. The
+group/number-pairs of grp are replaced by pairs of newgrp. If newgrp is nil,
+the pairs are removed.
+
+All articles are processed, even if some entries can not be rewritten. The
+first error is returned.
+*/
+func(e *Expirer) riGroup(src, grp, newgrp []byte) error {
+	tok := new(storage.TOKEN)
+	ove := new(storage.OverviewElement)
+	cur,err := e.OV.FetchAll(src,0,math.MaxInt64,tok,ove)
+	if err!=nil { return err }
+	defer cur.Release()
+	
+	var first error
+	var failed int64
+	old := new(storage.RiElement)
+	rie := new(storage.RiElement)
+	for cur.Next() {
+		*old = storage.RiElement{Group: grp, Num: ove.Num}
+		if newgrp==nil {
+			err = e.RI.RiReplace(ove.MsgId,old,nil)
+		} else {
+			*rie = storage.RiElement{Group: newgrp, Num: ove.Num}
+			err = e.RI.RiReplace(ove.MsgId,old,rie)
+		}
+		if err!=nil {
+			if first==nil { first = err }
+			failed++
+		}
+	}
+	if first!=nil { return fmt.Errorf("%d reverse index entries of %s not rewritten: %v",failed,grp,first) }
+	return nil
+}
+
+/*
+Removes a group from the overview database and the reverse index.
+The articles themselves are left to expire.
+
+The group is removed, even if its reverse index entries could not be removed.
+The error is returned nonetheless.
+*/
+func(e *Expirer) RemoveGroup(grp []byte) error {
+	if e.OV==nil { return ECouldNotQuery }
+	if _,_,_,err := e.OV.GroupStat(grp); err!=nil { return err }
+	var rierr error
+	if e.RI!=nil { rierr = e.riGroup(grp,grp,nil) }
+	if err := e.OV.RemoveGroup(grp); err!=nil { return err }
+	return rierr
+}
+
+/*
+Renames a group in the overview database and the reverse index. The reverse
+index is only rewritten, after the group has been renamed.
+
+Articles, that are posted to the group while it is being renamed,
+may retain the old group name in the reverse index.
+*/
+func(e *Expirer) RenameGroup(oldgrp, newgrp []byte) error {
+	if e.OV==nil { return ECouldNotQuery }
+	if err := e.OV.RenameGroup(oldgrp,newgrp); err!=nil { return err }
+	if e.RI!=nil { return e.riGroup(newgrp,oldgrp,newgrp) }
+	return nil
+}
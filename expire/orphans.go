@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package expire
+
+import "github.com/byte-mug/fastnntp-backend2/storage"
+import "github.com/byte-mug/fastnntp-backend2/iohelper"
+import "github.com/byte-mug/fastnntp-backend2/utils/header"
+import "bytes"
+import "context"
+import "encoding/hex"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "time"
+
+/*
+Statistics of an orphan sweep.
+*/
+type SweepReport struct {
+	DryRun bool
+	
+	// Articles older than the grace period, that have been checked.
+	Scanned int64
+	
+	// Articles referenced neither by the history nor by the overview.
+	Orphans int64
+	
+	// Orphans, that have been (quarantined and) deleted.
+	Removed int64
+	
+	Failed    int64
+	LastError error
+}
+
+func (r *SweepReport) fail(err error) {
+	r.Failed++
+	r.LastError = err
+}
+
+type sweeper struct {
+	*Expirer
+	tw   storage.TokenWalker
+	buf  bytes.Buffer
+	tk   storage.TOKEN
+	ove  storage.OverviewElement
+	rie  storage.RiElement
+}
+
+func (s *sweeper) same(t *storage.TOKEN) bool {
+	s.tw.Canonical(&s.tk)
+	return s.tk==*t
+}
+
+/*
+Reports, whether the article t is referenced by the history or the overview.
+If the article can't be read, it is assumed to be referenced.
+*/
+func (s *sweeper) referenced(t *storage.TOKEN) bool {
+	obj,_,err := s.SM.Retrieve(t,storage.SM_Head)
+	if err!=nil { return true }
+	s.buf.Reset()
+	_,err = obj.WriteTo(&iohelper.Splitter{Head: &s.buf, Body: ioutil.Discard})
+	obj.Release()
+	if err!=nil { return true }
+	
+	msgid := header.Get(s.buf.Bytes(),[]byte("Message-ID"))
+	if len(msgid)==0 { return false }
+	msgid = append([]byte(nil),msgid...)
+	
+	if s.HIS!=nil && s.HIS.HisLookup(msgid,&s.tk)==nil && s.same(t) { return true }
+	
+	if s.RI!=nil && s.OV!=nil {
+		cur,err := s.RI.RiLookupAll(msgid,&s.rie)
+		if err!=nil { return false }
+		defer cur.Release()
+		for cur.Next() {
+			rel,err := s.OV.FetchOne(s.rie.Group,s.rie.Num,&s.tk,&s.ove)
+			if err!=nil { continue }
+			if rel!=nil { rel.Release() }
+			if s.same(t) { return true }
+		}
+	}
+	return false
+}
+
+func (s *sweeper) quarantine(dir string, t *storage.TOKEN) (err error) {
+	obj,_,err := s.SM.Retrieve(t,storage.SM_All)
+	if err!=nil { return }
+	defer obj.Release()
+	
+	f,err := os.OpenFile(filepath.Join(dir,hex.EncodeToString(t[:])),os.O_WRONLY|os.O_CREATE|os.O_TRUNC,0600)
+	if err!=nil { return }
+	_,err = obj.WriteTo(f)
+	if e := f.Close(); err==nil { err = e }
+	return
+}
+
+/*
+Finds stored articles, that are referenced neither by the history nor by the
+overview, for example because a posting failed after the article had been stored.
+Articles, that arrived within the grace period, are not touched.
+
+If quarantine is not empty, orphans are copied into that directory before they are deleted.
+If dryRun is true, nothing is deleted.
+
+Only storage methods implementing storage.TokenWalker are swept.
+*/
+func (e *Expirer) SweepOrphans(ctx context.Context, grace time.Duration, quarantine string, dryRun bool) (rep *SweepReport, err error) {
+	rep = &SweepReport{DryRun: dryRun}
+	if e.SM==nil { return }
+	if quarantine!="" && !dryRun {
+		err = os.MkdirAll(quarantine,0750)
+		if err!=nil { return }
+	}
+	
+	cutoff := time.Now().Add(-grace)
+	s := &sweeper{Expirer: e}
+	for i,sm := range e.SM.Classes {
+		tw,ok := sm.(storage.TokenWalker)
+		if !ok { continue }
+		s.tw = tw
+		err = tw.WalkTokens(byte(i),func(t *storage.TOKEN, arrival time.Time) error {
+			if err := ctx.Err(); err!=nil { return err }
+			if arrival.After(cutoff) { return nil }
+			rep.Scanned++
+			if s.referenced(t) { return nil }
+			rep.Orphans++
+			if dryRun { return nil }
+			
+			if quarantine!="" {
+				if err := s.quarantine(quarantine,t); err!=nil {
+					rep.fail(err)
+					return nil
+				}
+			}
+			if err := sm.Cancel(t); err!=nil {
+				rep.fail(err)
+				return nil
+			}
+			rep.Removed++
+			return nil
+		})
+		if err!=nil { return }
+	}
+	return
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package expire
+
+import "time"
+
+/*
+Per-group statistics of an expire run.
+*/
+type GroupStats struct {
+	Articles int64
+	Bytes    int64
+}
+
+/*
+Per-store statistics of an expire run.
+*/
+type StoreStats struct {
+	Failed    int64
+	LastError error
+}
+
+func (s *StoreStats) add(err error) {
+	if err==nil { return }
+	s.Failed++
+	s.LastError = err
+}
+
+/*
+Statistics of an expire run.
+*/
+type Report struct {
+	DryRun bool
+	
+	// Removed (or, if DryRun, removable) articles.
+	Articles int64
+	Bytes    int64
+	Groups   map[string]*GroupStats
+	
+	// Expired history tombstones, that have been removed.
+	Tombstones int64
+	
+	// Failures per store.
+	OV, HIS, RI, SM StoreStats
+	
+	Started  time.Time
+	Duration time.Duration
+}
+
+func newReport(dryRun bool) *Report {
+	return &Report{
+		DryRun: dryRun,
+		Groups: make(map[string]*GroupStats),
+		Started: time.Now(),
+	}
+}
+
+func (r *Report) group(grp []byte) *GroupStats {
+	gs := r.Groups[string(grp)]
+	if gs==nil {
+		gs = new(GroupStats)
+		r.Groups[string(grp)] = gs
+	}
+	return gs
+}
+
+func (r *Report) finish() {
+	r.Duration = time.Since(r.Started)
+}
+
+// Returns the total number of failures.
+func (r *Report) Failures() int64 {
+	return r.OV.Failed+r.HIS.Failed+r.RI.Failed+r.SM.Failed
+}
@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package newscaps
+
+import (
+	"github.com/byte-mug/fastnntp"
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"github.com/byte-mug/fastnntp-backend2/iohelper"
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+	"io/ioutil"
+	"bytes"
+	"strconv"
+)
+
+/*
+Receives the result lines of HDR, XHDR and XPAT.
+
+For requests by Message-ID, num is 0.
+*/
+type IHeader interface {
+	WriteHeader(num int64, value []byte) error
+}
+
+/*
+Header retrieval capabilities. Used to implement HDR, XHDR and XPAT.
+
+If wm is not nil, only the articles whose header value matches wm are returned (XPAT).
+*/
+type HeaderCaps interface {
+	GetHeader(a *fastnntp.ArticleRange, hdr []byte, wm *fastnntp.WildMat) func(w IHeader)
+}
+
+var _ HeaderCaps = (*ArticleReader)(nil)
+
+type ovField uint8
+const (
+	ovf_None ovField = iota
+	ovf_Subject
+	ovf_From
+	ovf_Date
+	ovf_MsgId
+	ovf_Refs
+	ovf_Bytes
+	ovf_Lines
+)
+
+var ovFields = map[string]ovField{
+	"subject"   : ovf_Subject,
+	"from"      : ovf_From,
+	"date"      : ovf_Date,
+	"message-id": ovf_MsgId,
+	"references": ovf_Refs,
+	"bytes"     : ovf_Bytes,
+	":bytes"    : ovf_Bytes,
+	"lines"     : ovf_Lines,
+	":lines"    : ovf_Lines,
+}
+
+func ovFieldOf(hdr []byte) ovField {
+	return ovFields[string(bytes.ToLower(hdr))]
+}
+
+func (f ovField) value(ove *storage.OverviewElement, buf []byte) []byte {
+	switch f {
+	case ovf_Subject: return ove.Subject
+	case ovf_From: return ove.From
+	case ovf_Date: return ove.Date
+	case ovf_MsgId: return ove.MsgId
+	case ovf_Refs: return ove.Refs
+	case ovf_Bytes: return strconv.AppendInt(buf[:0],ove.Lng,10)
+	case ovf_Lines: return strconv.AppendInt(buf[:0],ove.Lines,10)
+	}
+	return nil
+}
+
+/*
+Retrieves the header of the article and looks up the header field hdr.
+
+A missing header field results in an empty value. If the article could not be
+retrieved, ok is false.
+*/
+func (ar *ArticleReader) tHeader(t *storage.TOKEN, hdr []byte, buf *bytes.Buffer) (value []byte, ok bool) {
+	if ar.SM==nil { return }
+	obj,_,err := ar.SM.Retrieve(t,storage.SM_Head)
+	if err!=nil { return }
+	defer obj.Release()
+	
+	buf.Reset()
+	_,err = obj.WriteTo(&iohelper.Splitter{Head: buf, Body: ioutil.Discard})
+	if err!=nil { return }
+	
+	return header.Get(buf.Bytes(),hdr),true
+}
+
+func (ar *ArticleReader) GetHeader(a *fastnntp.ArticleRange, hdr []byte, wm *fastnntp.WildMat) func(w IHeader) {
+	pt := new(storage.TOKEN)
+	pove := new(storage.OverviewElement)
+	f := ovFieldOf(hdr)
+	
+	if a.HasId {
+		found := false
+		
+		/* Overview fields are answered from the overview, if possible. */
+		if f!=ovf_None && ar.RI!=nil && ar.OV!=nil {
+			rie := new(storage.RiElement)
+			rel,err := ar.RI.RiLookup(a.MessageId,rie)
+			if rel!=nil { rel.Release() }
+			if err==nil {
+				rel,err = ar.OV.FetchOne(rie.Group,rie.Num,pt,pove)
+				if rel!=nil { rel.Release() }
+				found = err==nil
+			}
+		}
+		if !found {
+			if ar.HIS==nil { return nil }
+			if ar.HIS.HisLookup(a.MessageId,pt)!=nil { return nil }
+			f = ovf_None
+		}
+		
+		return func(w IHeader) {
+			var value []byte
+			ok := true
+			if f!=ovf_None {
+				value = f.value(pove,make([]byte,0,24))
+			} else {
+				value,ok = ar.tHeader(pt,hdr,new(bytes.Buffer))
+			}
+			if !ok { return }
+			if wm!=nil && !wm.Match(value) { return }
+			w.WriteHeader(0,value)
+		}
+	}
+	if a.HasNum && ar.OV!=nil {
+		cur,err := ar.OV.FetchAll(a.Group,a.Number,a.LastNumber,pt,pove)
+		if err!=nil { return nil }
+		
+		return func(w IHeader) {
+			defer cur.Release()
+			buf := new(bytes.Buffer)
+			nbuf := make([]byte,0,24)
+			for cur.Next() {
+				var value []byte
+				ok := true
+				if f!=ovf_None {
+					value = f.value(pove,nbuf)
+				} else {
+					value,ok = ar.tHeader(pt,hdr,buf)
+				}
+				if !ok { continue } /* Article vanished. Skip it. */
+				if wm!=nil && !wm.Match(value) { continue }
+				
+				/*
+				 * At this point, an error indicates an IO error.
+				 * We need to be gentle at this point.
+				 */
+				if w.WriteHeader(pove.Num,value)!=nil { break }
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"fmt"
+	"sync"
+)
+
+type activeEntry struct {
+	status byte
+	alias  []byte
+}
+
+/*
+The status flags of the active file, as obtained from a GroupMethod.
+
+	y        Posting allowed.
+	n        No local posting. Articles from peers are accepted.
+	m        Moderated.
+	x        No local posting. Articles from peers are ignored.
+	j        Articles are filed into the junk group.
+	=alias   Articles are filed into the group alias.
+*/
+type Active struct {
+	mu sync.RWMutex
+	m  map[string]activeEntry
+}
+
+// Loads the active file from gm.
+func LoadActive(gm storage.GroupMethod) (a *Active, err error) {
+	a = new(Active)
+	err = a.Reload(gm)
+	if err!=nil { a = nil }
+	return
+}
+
+// Reloads the active file from gm.
+func (a *Active) Reload(gm storage.GroupMethod) (err error) {
+	ge := new(storage.GroupElement)
+	cur,err := gm.FetchGroups(true,false,ge)
+	if err!=nil { return }
+	defer cur.Release()
+	
+	m := make(map[string]activeEntry)
+	for cur.Next() {
+		m[string(ge.Group)] = activeEntry{ge.Status,append([]byte(nil),ge.Alias...)}
+	}
+	a.mu.Lock()
+	a.m = m
+	a.mu.Unlock()
+	return
+}
+
+// Returns the status of a group. ok is false, if the group does not exist.
+func (a *Active) Lookup(grp []byte) (status byte, alias []byte, ok bool) {
+	a.mu.RLock()
+	e,ok := a.m[string(grp)]
+	a.mu.RUnlock()
+	return e.status,e.alias,ok
+}
+
+// The maximum number of =alias redirections, that are followed.
+const max_alias = 8
+
+/*
+Filters the groups of an article according to Allow and the active file.
+Nonexistent groups are dropped, =alias groups are rewritten and j groups are
+replaced by the junk group. The result contains no duplicates, unless there is
+no active file.
+
+Local posts to n and x groups are refused as a whole.
+*/
+func (c *StorageWriter) filterGroups(ngrps [][]byte) ([][]byte, error) {
+	if c.Active==nil {
+		if c.Allow==nil { return ngrps,nil }
+		res := make([][]byte,0,len(ngrps))
+		for _,grp := range ngrps {
+			if c.Allow.Match(grp) { res = append(res,grp) }
+		}
+		return res,nil
+	}
+	junk := c.Junk
+	if len(junk)==0 { junk = []byte("junk") }
+	
+	res := make([][]byte,0,len(ngrps))
+	seen := make(map[string]bool,len(ngrps))
+	add := func(grp []byte) {
+		if seen[string(grp)] { return }
+		seen[string(grp)] = true
+		res = append(res,grp)
+	}
+	for _,grp := range ngrps {
+		if c.Allow!=nil && !c.Allow.Match(grp) { continue }
+		status,alias,ok := c.Active.Lookup(grp)
+		for i := 0; ok && status=='=' && i<max_alias; i++ {
+			grp = alias
+			status,alias,ok = c.Active.Lookup(grp)
+		}
+		if !ok { continue }
+		switch status {
+		case 'y','m': add(grp)
+		case 'n','x':
+			if c.Local { return nil,fmt.Errorf("posting to %s not allowed",grp) }
+			if status=='n' { add(grp) }
+		case 'j': add(junk)
+		}
+	}
+	return res,nil
+}
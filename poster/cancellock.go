@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"github.com/byte-mug/fastnntp-backend2/iohelper"
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+	
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+Cancel-Lock and Cancel-Key (RFC 8315).
+
+An article carries Cancel-Lock: elements "scheme:base64(hash(key))". A cancel or
+a superseding article is only honored, if one of its Cancel-Key: elements
+"scheme:key" hashes to one of the locks of the original article.
+*/
+
+var cl_schemes = map[string]func() hash.Hash{
+	"sha1"  : sha1.New,
+	"sha256": sha256.New,
+}
+
+// Splits a Cancel-Lock or Cancel-Key value into its elements.
+func clElements(values [][]byte) (scheme, value []string) {
+	for _,v := range values {
+		for _,e := range strings.Fields(string(v)) {
+			i := strings.IndexByte(e,':')
+			if i<=0 { continue }
+			scheme = append(scheme,strings.ToLower(e[:i]))
+			value = append(value,e[i+1:])
+		}
+	}
+	return
+}
+
+func clHash(scheme, key string) string {
+	ha := cl_schemes[scheme]()
+	ha.Write([]byte(key))
+	return base64.StdEncoding.EncodeToString(ha.Sum(nil))
+}
+
+/*
+Returns the Cancel-Key element for an article, derived from a server secret.
+uid identifies the poster and may be empty.
+*/
+func CancelKey(secret, uid, msgid []byte) string {
+	mac := hmac.New(sha256.New,secret)
+	mac.Write(uid)
+	mac.Write(msgid)
+	return "sha256:"+base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the Cancel-Lock element matching a Cancel-Key element.
+func CancelLock(key string) string {
+	i := strings.IndexByte(key,':')
+	if i<=0 { return "" }
+	scheme := strings.ToLower(key[:i])
+	if cl_schemes[scheme]==nil { return "" }
+	return scheme+":"+clHash(scheme,key[i+1:])
+}
+
+/*
+Reports, whether one of the Cancel-Key elements keys opens one of the Cancel-Lock elements locks.
+*/
+func VerifyCancelKey(locks, keys [][]byte) bool {
+	ls,lv := clElements(locks)
+	ks,kv := clElements(keys)
+	for i := range ks {
+		if cl_schemes[ks[i]]==nil { continue }
+		h := clHash(ks[i],kv[i])
+		for j := range ls {
+			if ls[j]==ks[i] && hmac.Equal([]byte(lv[j]),[]byte(h)) { return true }
+		}
+	}
+	return false
+}
+
+// Adds (or extends) a header field. The line ending of head is preserved.
+func addHeader(head []byte, name, value string) []byte {
+	nl := "\n"
+	if bytes.Contains(head,[]byte("\r\n")) { nl = "\r\n" }
+	if old := header.Get(head,[]byte(name)); len(old)!=0 {
+		value = string(old)+" "+value
+		head = header.Remove(head,[]byte(name))
+	}
+	if len(head)>0 && head[len(head)-1]!='\n' { head = append(head,nl...) }
+	return append(head,(name+": "+value+nl)...)
+}
+
+/*
+For authenticated local posters: adds a Cancel-Lock: to the article and a
+Cancel-Key: to cancels and superseding articles, that lack one. The Cancel-Key:
+is only added, if the target has been posted by the same user.
+*/
+func (c *StorageWriter) cancelLock(head []byte, msgid []byte) []byte {
+	if !c.Local || len(c.CancelSecret)==0 || len(c.User)==0 { return head }
+	head = addHeader(head,"Cancel-Lock",CancelLock(CancelKey(c.CancelSecret,c.User,msgid)))
+	
+	if len(header.Get(head,[]byte("Cancel-Key")))!=0 { return head }
+	target := header.Get(head,[]byte("Supersedes"))
+	if f := strings.Fields(string(header.Get(head,[]byte("Control")))); len(f)>1 && strings.EqualFold(f[0],"cancel") {
+		target = []byte(f[1])
+	}
+	if len(target)==0 { return head }
+	key := CancelKey(c.CancelSecret,c.User,target)
+	locks := header.GetAll(c.storedHead(target),[]byte("Cancel-Lock"))
+	if VerifyCancelKey(locks,[][]byte{[]byte(key)}) {
+		head = addHeader(head,"Cancel-Key",key)
+	}
+	return head
+}
+
+// Returns the header of a stored article or nil.
+func (c *StorageWriter) storedHead(msgid []byte) []byte {
+	tk := new(storage.TOKEN)
+	if c.HIS==nil || c.HIS.HisLookup(msgid,tk)!=nil { return nil }
+	obj,_,err := c.SM.Retrieve(tk,storage.SM_Head)
+	if err!=nil { return nil }
+	defer obj.Release()
+	var buf bytes.Buffer
+	_,err = obj.WriteTo(&iohelper.Splitter{Head: &buf, Body: ioutil.Discard})
+	if err!=nil { return nil }
+	return buf.Bytes()
+}
+
+/*
+Reports, whether the cancel (or superseding article) head may cancel msgid.
+Articles without Cancel-Lock: are not protected.
+*/
+func (c *StorageWriter) cancelUnlocked(head []byte, msgid []byte) bool {
+	locks := header.GetAll(c.storedHead(msgid),[]byte("Cancel-Lock"))
+	if len(locks)==0 { return true }
+	return VerifyCancelKey(locks,header.GetAll(head,[]byte("Cancel-Key")))
+}
@@ -0,0 +1,317 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp/posting"
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+	
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Verifies the PGP signature of a control message.
+*/
+type PGPVerifier interface {
+	Verify(key string, head, body []byte) bool
+}
+
+// Returns the address of the sender: Sender: if present, otherwise From:.
+func sender(head []byte) []byte {
+	s := header.Get(head,[]byte("Sender"))
+	if len(s)==0 { s = header.Get(head,[]byte("From")) }
+	if a,err := mail.ParseAddress(string(s)); err==nil { return []byte(a.Address) }
+	return s
+}
+
+func (c *StorageWriter) logControl(format string, args ...interface{}) {
+	if c.ControlLog!=nil { c.ControlLog(fmt.Sprintf(format,args...)) }
+}
+
+/*
+Decides, whether a control message may be executed. If there is no matching
+rule, dflt is returned.
+*/
+func (c *StorageWriter) allowed(msg string, head, body []byte, grp []byte, dflt bool) bool {
+	if c.Control==nil { return dflt }
+	snd := sender(head)
+	a,ok := c.Control.Decide(msg,snd,grp)
+	if !ok { return dflt }
+	switch a.Act {
+	case Act_Doit: return true
+	case Act_Log: c.logControl("%s %s from %s: logged",msg,grp,snd)
+	case Act_Verify:
+		if c.PGP!=nil && c.PGP.Verify(a.Key,head,body) { return true }
+		c.logControl("%s %s from %s: verification with %q failed",msg,grp,snd,a.Key)
+	}
+	return false
+}
+
+/*
+Decides, whether a control message may be executed, based on the groups it
+has been posted to. It must be allowed for each of them.
+*/
+func (c *StorageWriter) allowedPosted(msg string, head, body []byte, dflt bool) bool {
+	grps := posting.SplitNewsgroups(header.Get(head,[]byte("Newsgroups")))
+	if len(grps)==0 { return c.allowed(msg,head,body,nil,dflt) }
+	for _,grp := range grps {
+		if !c.allowed(msg,head,body,grp,dflt) { return false }
+	}
+	return true
+}
+
+func (c *StorageWriter) reloadActive() {
+	gm,ok := c.Groups.(storage.GroupMethod)
+	if ok && c.Active!=nil { c.Active.Reload(gm) }
+}
+
+/*
+Returns the description of grp from the body of a newgroup or checkgroups
+message, which contains lines of the form "group<TAB>description".
+*/
+func description(body []byte, grp []byte) []byte {
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		f := bytes.Fields(sc.Bytes())
+		if len(f)<2 || !bytes.Equal(f[0],grp) { continue }
+		return bytes.TrimSpace(sc.Bytes()[len(grp):])
+	}
+	return nil
+}
+
+func (c *StorageWriter) newgroup(msg string, head, body []byte, grp []byte, moderated bool) {
+	if c.Groups==nil || !c.allowed(msg,head,body,grp,false) { return }
+	ge := &storage.GroupElement{Group: grp, Status: 'y', Description: description(body,grp)}
+	if moderated { ge.Status = 'm' }
+	if err := c.Groups.PutGroup(ge); err!=nil {
+		c.logControl("%s %s: %v",msg,grp,err)
+		return
+	}
+	if c.OV!=nil { c.OV.InitGroup(grp) }
+	c.logControl("%s %s: created",msg,grp)
+}
+
+func (c *StorageWriter) rmgroup(msg string, head, body []byte, grp []byte) {
+	if c.Groups==nil || !c.allowed(msg,head,body,grp,false) { return }
+	if err := c.Groups.DeleteGroup(grp); err!=nil {
+		c.logControl("%s %s: %v",msg,grp,err)
+		return
+	}
+	if c.Expirer!=nil {
+		c.Expirer.RemoveGroup(grp)
+	} else if c.OV!=nil {
+		c.OV.RemoveGroup(grp)
+	}
+	c.logControl("%s %s: removed",msg,grp)
+}
+
+/*
+The arguments of a checkgroups control message: "[scope] [#serial]" (RFC 5537).
+serial is -1, if there is none.
+*/
+type chkScope struct {
+	names  []string
+	serial int64
+}
+
+func parseChkScope(args []string) (cs chkScope) {
+	cs.serial = -1
+	for _,a := range args {
+		if strings.HasPrefix(a,"#") {
+			if n,err := strconv.ParseInt(a[1:],10,64); err==nil { cs.serial = n }
+			continue
+		}
+		cs.names = append(cs.names,a)
+	}
+	return
+}
+
+/*
+Reports, whether grp is within the scope. The longest matching name decides,
+names prefixed with "!" exclude groups.
+*/
+func (cs *chkScope) contains(grp string) bool {
+	best,in := -1,false
+	for _,n := range cs.names {
+		excl := strings.HasPrefix(n,"!")
+		if excl { n = n[1:] }
+		if grp!=n && !strings.HasPrefix(grp,n+".") { continue }
+		if len(n)>best { best,in = len(n),!excl }
+	}
+	return in
+}
+
+// Returns a key identifying the scope.
+func (cs *chkScope) key() string {
+	k := append([]string(nil),cs.names...)
+	sort.Strings(k)
+	return strings.Join(k," ")
+}
+
+/*
+The serial numbers of the applied checkgroups messages, per scope. If Path is
+set, they are stored in this file, one "serial scope" line each.
+*/
+type CheckgroupsSerials struct {
+	Path string
+	
+	mu     sync.Mutex
+	loaded bool
+	m      map[string]int64
+}
+
+func (s *CheckgroupsSerials) load() {
+	s.loaded = true
+	s.m = make(map[string]int64)
+	if s.Path=="" { return }
+	data,err := ioutil.ReadFile(s.Path)
+	if err!=nil { return }
+	for _,line := range strings.Split(string(data),"\n") {
+		f := strings.SplitN(line," ",2)
+		if len(f)!=2 { continue }
+		if n,err := strconv.ParseInt(f[0],10,64); err==nil { s.m[f[1]] = n }
+	}
+}
+
+func (s *CheckgroupsSerials) save() error {
+	if s.Path=="" { return nil }
+	var buf bytes.Buffer
+	for k,n := range s.m { fmt.Fprintf(&buf,"%d %s\n",n,k) }
+	tmp := s.Path+".tmp"
+	err := ioutil.WriteFile(tmp,buf.Bytes(),0644)
+	if err==nil { err = os.Rename(tmp,s.Path) }
+	return err
+}
+
+/*
+Reports, whether serial is newer than the last serial applied to scope. If so,
+it is recorded as the last one.
+*/
+func (s *CheckgroupsSerials) Newer(scope string, serial int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded { s.load() }
+	if last,ok := s.m[scope]; ok && serial<=last { return false }
+	s.m[scope] = serial
+	s.save()
+	return true
+}
+
+/*
+Applies a checkgroups message. The body lists all groups of the scope. Missing
+groups are created, unlisted groups of the scope are removed. Without scope,
+the hierarchies of the listed groups are the scope.
+*/
+func (c *StorageWriter) checkgroups(head, body []byte, args []string) {
+	if c.Groups==nil { return }
+	cs := parseChkScope(args)
+	listed := make(map[string][]byte)
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		f := bytes.Fields(sc.Bytes())
+		if len(f)==0 || bytes.IndexByte(f[0],'.')<0 { continue }
+		grp := append([]byte(nil),f[0]...)
+		if len(cs.names)!=0 && !cs.contains(string(grp)) { continue }
+		listed[string(grp)] = bytes.TrimSpace(sc.Bytes()[len(grp):])
+	}
+	if len(cs.names)==0 {
+		seen := make(map[string]bool)
+		for grp := range listed {
+			h := grp[:strings.IndexByte(grp,'.')]
+			if !seen[h] { cs.names = append(cs.names,h) }
+			seen[h] = true
+		}
+	}
+	if len(cs.names)==0 { return }
+	
+	if cs.serial>=0 && c.Checkgroups!=nil && !c.Checkgroups.Newer(cs.key(),cs.serial) {
+		c.logControl("checkgroups %s: serial #%d is not newer, ignored",cs.key(),cs.serial)
+		return
+	}
+	
+	var have map[string]bool
+	if gm,ok := c.Groups.(storage.GroupMethod); ok {
+		have = make(map[string]bool)
+		ge := new(storage.GroupElement)
+		if cur,err := gm.FetchGroups(true,false,ge); err==nil {
+			for cur.Next() { have[string(ge.Group)] = true }
+			cur.Release()
+		}
+	}
+	
+	for grp,descr := range listed {
+		if have[grp] { continue }
+		moderated := bytes.HasSuffix(descr,[]byte("(Moderated)"))
+		c.newgroup("checkgroups",head,body,[]byte(grp),moderated)
+	}
+	for grp := range have {
+		if _,ok := listed[grp]; ok || !cs.contains(grp) { continue }
+		c.rmgroup("checkgroups",head,body,[]byte(grp))
+	}
+}
+
+func (c *StorageWriter) cancel(head, body []byte, msgid []byte) {
+	if c.Expirer==nil || len(msgid)==0 { return }
+	if !c.allowedPosted("cancel",head,body,true) { return }
+	if !c.cancelUnlocked(head,msgid) {
+		c.logControl("cancel %s: Cancel-Key does not match",msgid)
+		return
+	}
+	c.Expirer.CancelMessageId(msgid)
+}
+
+/*
+Executes the control message and the Supersedes: header of an article, that has been stored.
+*/
+func (c *StorageWriter) control(head, body []byte) {
+	if sup := header.Get(head,[]byte("Supersedes")); len(sup)!=0 {
+		c.cancel(head,body,sup)
+	}
+	
+	ctl := strings.Fields(string(header.Get(head,[]byte("Control"))))
+	if len(ctl)==0 { return }
+	switch strings.ToLower(ctl[0]) {
+	case "cancel":
+		if len(ctl)>1 { c.cancel(head,body,[]byte(ctl[1])) }
+		return
+	case "newgroup":
+		if len(ctl)>1 { c.newgroup("newgroup",head,body,[]byte(ctl[1]),len(ctl)>2 && strings.EqualFold(ctl[2],"moderated")) }
+	case "rmgroup":
+		if len(ctl)>1 { c.rmgroup("rmgroup",head,body,[]byte(ctl[1])) }
+	case "checkgroups":
+		c.checkgroups(head,body,ctl[1:])
+	default: return
+	}
+	/* Only group changes affect the active file. */
+	c.reloadActive()
+}
@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp"
+	
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type ControlAct uint8
+const (
+	Act_Drop ControlAct = iota
+	Act_Doit
+	Act_Log    // The message is logged, but not executed.
+	Act_Verify // The message is executed, if its PGP signature can be verified with Key.
+)
+
+type ControlAction struct {
+	Act ControlAct
+	Key string
+}
+
+/*
+A rule of a control.ctl file.
+*/
+type ControlRule struct {
+	Message string // The type of control message or "all".
+	From    string // Wildmat of the sender address.
+	Groups  string // Wildmat of the affected groups.
+	Action  ControlAction
+	
+	fwm, gwm *fastnntp.WildMat
+}
+
+/*
+A control.ctl style policy. Each line has the form
+
+	message:from:newsgroups:action
+
+where action is one of doit, drop, log, mail or verify-<key>. An "=file"
+suffix of the action is ignored. The last matching rule decides.
+*/
+type ControlPolicy struct {
+	Rules []*ControlRule
+}
+
+func parseControlAction(s string) (a ControlAction, err error) {
+	if i := strings.IndexByte(s,'='); i>=0 { s = s[:i] }
+	switch {
+	case s=="doit": a.Act = Act_Doit
+	case s=="drop": a.Act = Act_Drop
+	case s=="log",s=="mail": a.Act = Act_Log
+	case strings.HasPrefix(s,"verify-"):
+		a.Act = Act_Verify
+		a.Key = s[len("verify-"):]
+	default: err = fmt.Errorf("bad action %q",s)
+	}
+	return
+}
+
+// Parses a control.ctl style file.
+func ParseControlCtl(r io.Reader) (p *ControlPolicy, err error) {
+	p = new(ControlPolicy)
+	sc := bufio.NewScanner(r)
+	lno := 0
+	for sc.Scan() {
+		lno++
+		line := sc.Text()
+		if i := strings.IndexByte(line,'#'); i>=0 { line = line[:i] }
+		line = strings.TrimSpace(line)
+		if line=="" { continue }
+		
+		f := strings.Split(line,":")
+		if len(f)!=4 { return nil,fmt.Errorf("control.ctl:%d: expected 4 fields",lno) }
+		ru := &ControlRule{
+			Message: strings.ToLower(strings.TrimSpace(f[0])),
+			From: strings.ToLower(strings.TrimSpace(f[1])),
+			Groups: strings.TrimSpace(f[2]),
+		}
+		ru.Action,err = parseControlAction(strings.ToLower(strings.TrimSpace(f[3])))
+		if err!=nil { return nil,fmt.Errorf("control.ctl:%d: %v",lno,err) }
+		ru.fwm = fastnntp.ParseWildMat(ru.From)
+		if err = ru.fwm.Compile(); err!=nil { return nil,fmt.Errorf("control.ctl:%d: %v",lno,err) }
+		ru.gwm = fastnntp.ParseWildMat(ru.Groups)
+		if err = ru.gwm.Compile(); err!=nil { return nil,fmt.Errorf("control.ctl:%d: %v",lno,err) }
+		p.Rules = append(p.Rules,ru)
+	}
+	err = sc.Err()
+	return
+}
+
+// Loads a control.ctl style file.
+func LoadControlCtl(path string) (*ControlPolicy, error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return ParseControlCtl(f)
+}
+
+/*
+Returns the action for a control message. ok is false, if no rule matches.
+*/
+func (p *ControlPolicy) Decide(msg string, sender, grp []byte) (a ControlAction, ok bool) {
+	sender = []byte(strings.ToLower(string(sender)))
+	for _,ru := range p.Rules {
+		if ru.Message!="all" && ru.Message!=msg { continue }
+		if !ru.fwm.Match(sender) || !ru.gwm.Match(grp) { continue }
+		a,ok = ru.Action,true
+	}
+	return
+}
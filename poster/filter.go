@@ -0,0 +1,205 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"bytes"
+	"hash/fnv"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+	
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+)
+
+/*
+The decision of an article filter.
+*/
+type Verdict int
+const (
+	Accept Verdict = iota
+	Reject // The article is refused.
+	Drop   // The article is accepted, but not stored.
+)
+
+/*
+The article, as seen by a filter.
+*/
+type ArticleInfo struct {
+	MessageId []byte
+	Head      []byte // Raw header, see utils/header.
+	Body      []byte // The first 64 KiB of the body.
+	Groups    [][]byte
+	Bytes     int64
+	Lines     int64
+	
+	// True, if posted by a local user rather than received from a peer.
+	Local bool
+}
+
+/*
+An article filter. reason should be set, unless the article is accepted.
+*/
+type Filter interface {
+	Filter(a *ArticleInfo) (v Verdict, reason string)
+}
+
+// Adapts a function to a Filter.
+type FilterFunc func(a *ArticleInfo) (v Verdict, reason string)
+
+func (f FilterFunc) Filter(a *ArticleInfo) (Verdict, string) { return f(a) }
+
+/*
+Statistics of a filter in a FilterChain.
+*/
+type FilterStats struct {
+	Name string
+	Accepted, Rejected, Dropped int64
+	LastReason string
+}
+
+type chainEntry struct {
+	name string
+	f    Filter
+	
+	accepted, rejected, dropped int64
+	reason atomic.Value
+}
+
+/*
+A sequence of filters. The first filter, that doesn't accept the article, decides.
+*/
+type FilterChain struct {
+	entries []*chainEntry
+}
+
+// Appends a filter to the chain. Must not be called, while the chain is in use.
+func (fc *FilterChain) Add(name string, f Filter) {
+	fc.entries = append(fc.entries,&chainEntry{name: name, f: f})
+}
+
+// Runs the filters.
+func (fc *FilterChain) Run(a *ArticleInfo) (v Verdict, reason string) {
+	for _,e := range fc.entries {
+		v,reason = e.f.Filter(a)
+		switch v {
+		case Accept:
+			atomic.AddInt64(&e.accepted,1)
+			continue
+		case Reject: atomic.AddInt64(&e.rejected,1)
+		default:     atomic.AddInt64(&e.dropped,1)
+		}
+		e.reason.Store(reason)
+		return
+	}
+	return Accept,""
+}
+
+// Returns the statistics of each filter, in order.
+func (fc *FilterChain) Stats() []FilterStats {
+	st := make([]FilterStats,len(fc.entries))
+	for i,e := range fc.entries {
+		st[i] = FilterStats{
+			Name: e.name,
+			Accepted: atomic.LoadInt64(&e.accepted),
+			Rejected: atomic.LoadInt64(&e.rejected),
+			Dropped: atomic.LoadInt64(&e.dropped),
+		}
+		st[i].LastReason,_ = e.reason.Load().(string)
+	}
+	return st
+}
+
+/*
+Matches a header field against a regular expression.
+*/
+type HeaderRule struct {
+	Header  string
+	Pattern *regexp.Regexp
+	Verdict Verdict
+	Reason  string
+}
+
+/*
+A filter consisting of header rules. The first matching rule decides.
+*/
+type HeaderRules []HeaderRule
+
+func (hr HeaderRules) Filter(a *ArticleInfo) (Verdict, string) {
+	for _,r := range hr {
+		for _,v := range header.GetAll(a.Head,[]byte(r.Header)) {
+			if r.Pattern.Match(v) { return r.Verdict,r.Reason }
+		}
+	}
+	return Accept,""
+}
+
+type empEntry struct {
+	count int
+	first time.Time
+}
+
+/*
+Detects excessive multi-posting (EMP): articles with the same body, that
+arrive more than Threshold times within Window, are rejected.
+Whitespace is ignored when comparing bodies.
+*/
+type EMPFilter struct {
+	Threshold int
+	Window    time.Duration
+	
+	mu    sync.Mutex
+	seen  map[uint64]*empEntry
+	prune time.Time
+}
+
+func bodyHash(body []byte) uint64 {
+	ha := fnv.New64a()
+	for _,f := range bytes.Fields(body) { ha.Write(f) }
+	return ha.Sum64()
+}
+
+func (e *EMPFilter) Filter(a *ArticleInfo) (Verdict, string) {
+	h := bodyHash(a.Body)
+	now := time.Now()
+	
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.seen==nil { e.seen = make(map[uint64]*empEntry) }
+	if now.After(e.prune) {
+		for k,v := range e.seen {
+			if now.Sub(v.first)>e.Window { delete(e.seen,k) }
+		}
+		e.prune = now.Add(e.Window)
+	}
+	
+	ent := e.seen[h]
+	if ent==nil || now.Sub(ent.first)>e.Window {
+		ent = &empEntry{first: now}
+		e.seen[h] = ent
+	}
+	ent.count++
+	if ent.count>e.Threshold { return Reject,"EMP" }
+	return Accept,""
+}
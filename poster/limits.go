@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+	
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ETooLarge        = errors.New("article too large")
+	ETooManyGroups   = errors.New("too many newsgroups")
+	ETooManyHeaders  = errors.New("too many header fields")
+	ELineTooLong     = errors.New("header line too long")
+	ENoGroups        = errors.New("no valid newsgroups")
+	ENoMessageId     = errors.New("no Message-ID")
+	EDuplicate       = errors.New("duplicate Message-ID")
+	EUnapproved      = errors.New("unapproved article to moderated group")
+)
+
+/*
+Limits for incoming articles. Zero values mean unlimited.
+*/
+type Limits struct {
+	MaxSize       int64 // Size of the article in bytes.
+	MaxCrosspost  int   // Number of newsgroups.
+	MaxHeaders    int   // Number of header fields.
+	MaxLineLength int   // Length of a header line.
+	
+	// Header fields, that must be present.
+	Required []string
+}
+
+// A required header field is missing.
+type missingHeader string
+
+func (m missingHeader) Error() string { return fmt.Sprintf("missing header %s",string(m)) }
+
+/*
+A reader, that fails with ETooLarge after n bytes.
+*/
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (n int, err error) {
+	if int64(len(p))>l.n+1 { p = p[:l.n+1] } /* Read one byte more, to detect an excess. */
+	n,err = l.r.Read(p)
+	if int64(n)>l.n {
+		n = int(l.n)
+		err = ETooLarge
+	}
+	l.n -= int64(n)
+	return
+}
+
+// Wraps r, if a size limit is configured.
+func (lm *Limits) reader(r io.Reader) io.Reader {
+	if lm==nil || lm.MaxSize<=0 { return r }
+	return &limitReader{r,lm.MaxSize}
+}
+
+// Checks the raw header of an incoming article.
+func (lm *Limits) checkHeader(head []byte) error {
+	if lm==nil { return nil }
+	if lm.MaxLineLength>0 {
+		for _,line := range bytes.Split(head,[]byte("\n")) {
+			if len(bytes.TrimRight(line,"\r"))>lm.MaxLineLength { return ELineTooLong }
+		}
+	}
+	if lm.MaxHeaders>0 {
+		n := 0
+		header.ForEach(head,func(name, value []byte) bool { n++; return true })
+		if n>lm.MaxHeaders { return ETooManyHeaders }
+	}
+	for _,req := range lm.Required {
+		if header.Get(head,[]byte(req))==nil { return missingHeader(req) }
+	}
+	return nil
+}
+
+func (lm *Limits) checkGroups(ngrps [][]byte) error {
+	if lm==nil || lm.MaxCrosspost<=0 || len(ngrps)<=lm.MaxCrosspost { return nil }
+	return ETooManyGroups
+}
+
+// Reports a rejected article.
+func (c *StorageWriter) reject(msgid []byte, reason error) {
+	if c.OnReject!=nil { c.OnReject(msgid,reason) }
+}
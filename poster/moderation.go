@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp"
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+	
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ENoModerator = errors.New("no moderator for group")
+
+type modEntry struct {
+	pattern string
+	wm      *fastnntp.WildMat
+	addr    string
+}
+
+/*
+An INN-style moderators file. Each line has the form
+
+	pattern:address
+
+The first line, whose pattern matches the group, is used. In the address,
+"%s" is replaced by the group name with '.' replaced by '-', and "%%" by '%'.
+*/
+type Moderators struct {
+	entries []modEntry
+}
+
+// Parses an INN-style moderators file.
+func ParseModerators(r io.Reader) (m *Moderators, err error) {
+	m = new(Moderators)
+	sc := bufio.NewScanner(r)
+	lno := 0
+	for sc.Scan() {
+		lno++
+		line := strings.TrimSpace(sc.Text())
+		if line=="" || line[0]=='#' { continue }
+		i := strings.IndexByte(line,':')
+		if i<0 { return nil,fmt.Errorf("moderators:%d: expected pattern:address",lno) }
+		e := modEntry{pattern: strings.TrimSpace(line[:i]), addr: strings.TrimSpace(line[i+1:])}
+		e.wm = fastnntp.ParseWildMat(e.pattern)
+		if err = e.wm.Compile(); err!=nil { return nil,fmt.Errorf("moderators:%d: %v",lno,err) }
+		m.entries = append(m.entries,e)
+	}
+	err = sc.Err()
+	return
+}
+
+// Loads an INN-style moderators file.
+func LoadModerators(path string) (*Moderators, error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return ParseModerators(f)
+}
+
+// Returns the submission address for a group.
+func (m *Moderators) Lookup(grp []byte) (addr string, ok bool) {
+	for _,e := range m.entries {
+		if !e.wm.Match(grp) { continue }
+		name := strings.Replace(string(grp),".","-",-1)
+		var b strings.Builder
+		for i := 0; i<len(e.addr); i++ {
+			if e.addr[i]=='%' && i+1<len(e.addr) {
+				switch e.addr[i+1] {
+				case 's': b.WriteString(name); i++; continue
+				case '%': b.WriteByte('%'); i++; continue
+				}
+			}
+			b.WriteByte(e.addr[i])
+		}
+		return b.String(),true
+	}
+	return
+}
+
+/*
+Receives articles, that have been posted to moderated groups without approval.
+*/
+type ModeratorSink interface {
+	Submit(addr string, grp []byte, article io.Reader) error
+}
+
+// Adapts a function to a ModeratorSink.
+type SinkFunc func(addr string, grp []byte, article io.Reader) error
+
+func (f SinkFunc) Submit(addr string, grp []byte, article io.Reader) error { return f(addr,grp,article) }
+
+/*
+A ModeratorSink, that stores each submission into a file in Dir. The file starts
+with a "To: <address>" line, followed by the article.
+*/
+type SpoolSink struct {
+	Dir    string
+	serial uint32
+}
+
+func (s *SpoolSink) Submit(addr string, grp []byte, article io.Reader) (err error) {
+	name := fmt.Sprintf("%x-%x",time.Now().UnixNano(),atomic.AddUint32(&s.serial,1))
+	tmp := filepath.Join(s.Dir,"."+name)
+	f,err := os.OpenFile(tmp,os.O_WRONLY|os.O_CREATE|os.O_EXCL,0600)
+	if err!=nil { return }
+	_,err = fmt.Fprintf(f,"To: %s\n",addr)
+	if err==nil { _,err = io.Copy(f,article) }
+	if e := f.Close(); err==nil { err = e }
+	if err==nil {
+		err = os.Rename(tmp,filepath.Join(s.Dir,name))
+	} else {
+		os.Remove(tmp)
+	}
+	return
+}
+
+/*
+Returns the first moderated group of the article, unless it is approved.
+*/
+func (c *StorageWriter) unapproved(head []byte, ngrps [][]byte) (grp []byte) {
+	if c.Active==nil { return nil }
+	if len(bytes.TrimSpace(header.Get(head,[]byte("Approved"))))!=0 { return nil }
+	for _,g := range ngrps {
+		if c.moderated(g) { return g }
+	}
+	return nil
+}
+
+func (c *StorageWriter) moderated(grp []byte) bool {
+	if c.Active==nil { return false }
+	status,_,_ := c.Active.Lookup(grp)
+	return status=='m'
+}
+
+/*
+Hands an unapproved article over to the moderator of grp.
+*/
+func (c *StorageWriter) submit(grp []byte, article io.Reader) error {
+	if c.Moderators==nil || c.Submit==nil { return ENoModerator }
+	addr,ok := c.Moderators.Lookup(grp)
+	if !ok { return ENoModerator }
+	return c.Submit.Submit(addr,grp,article)
+}
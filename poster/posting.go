@@ -28,10 +28,15 @@ import (
 	"github.com/byte-mug/fastnntp"
 	"github.com/byte-mug/fastnntp/posting"
 	"github.com/byte-mug/fastnntp-backend2/storage"
-	"github.com/byte-mug/fastnntp-backend2/iohelper"
+	"github.com/byte-mug/fastnntp-backend2/expire"
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
 	
+	"bufio"
 	"bytes"
+	"errors"
+	"io/ioutil"
 	"time"
+	"net/mail"
 	
 	// Temp
 	"fmt"
@@ -52,27 +57,95 @@ func (noopstamp) PathSeg(buf []byte) []byte { return nil }
 
 var noopstamp_inst posting.Stamper = noopstamp(0)
 
-type rBuffer struct{
-	bytes.Buffer
-}
-func (*rBuffer) Release() {}
-
 type StorageWriter struct {
 	Stamp posting.Stamper
 	SM    *storage.StorageManager
 	OV    storage.OverviewMethod
 	HIS   storage.HisMethod
 	RI    storage.RiMethod
+	
+	// Retention policy. If nil, articles expire after one day.
+	Policy *expire.Policy
+	
+	// The active file. If nil, the groups are not checked.
+	Active *Active
+	
+	// The group, articles to j groups are filed into. Default is "junk".
+	Junk []byte
+	
+	// Per-peer settings. Use one StorageWriter per peer, the other fields may be shared.
+	
+	// If true, the articles are posted by local users rather than received from peers.
+	Local bool
+	
+	// The authenticated local user. The Cancel-Locks of local posts are derived from it,
+	// so a user can only cancel own articles.
+	User []byte
+	
+	// If not nil, only the matching groups are accepted.
+	Allow *fastnntp.WildMat
+	
+	// If not nil, the articles are passed through these filters before they are stored.
+	Filter *FilterChain
+	
+	// Control messages and Supersedes: headers. Cancels are executed through Expirer,
+	// group changes are applied to Groups. If Control is nil, all cancels and no group changes are allowed.
+	Expirer    *expire.Expirer
+	Groups     storage.GroupWriter
+	Control    *ControlPolicy
+	PGP        PGPVerifier
+	ControlLog func(msg string)
+	
+	// If not nil, checkgroups messages are only applied, if their serial number is newer than the last one.
+	Checkgroups *CheckgroupsSerials
+	
+	// If set, local posts get a Cancel-Lock: header (and cancels a Cancel-Key:) derived from this secret and User.
+	CancelSecret []byte
+	
+	// Directory for spooling large articles. If empty, the default directory for temporary files is used.
+	TempDir string
+	
+	// Limits for incoming articles. If nil, there are no limits.
+	Limits *Limits
+	
+	// If not nil, called with the reason of each rejected article.
+	OnReject func(msgid []byte, reason error)
+	
+	// The name of this server in the Xref: header. If empty, the host name is used.
+	Server string
+	
+	// Unapproved local posts to moderated groups are submitted to their moderator.
+	Moderators *Moderators
+	Submit     ModeratorSink
 }
 
 const day = time.Hour*24
 
-func (c *StorageWriter) article_md() *storage.Article_MD {
+func (c *StorageWriter) article_md(head []byte, ngrps [][]byte) *storage.Article_MD {
 	a := new(storage.Article_MD)
 	a.Arrival = time.Now()
-	a.Expires = a.Arrival.Add(day) // TODO: make this configurable.
+	if c.Policy==nil {
+		a.Expires = a.Arrival.Add(day)
+		return a
+	}
+	var hdr time.Time
+	if e := header.Get(head,[]byte("Expires")); len(e)!=0 {
+		hdr,_ = mail.ParseDate(string(e))
+	}
+	a.Expires = c.Policy.Expires(a.Arrival,hdr,ngrps,c.moderated)
 	return a
 }
+/*
+Records a tombstone for a rejected article, if the policy says so. The history
+entry of a stored article with the same Message-ID is not overwritten.
+*/
+func (c *StorageWriter) remember(msgid []byte) {
+	if c.Policy==nil || c.Policy.Remember==0 { return }
+	if c.HIS.HisLookup(msgid,new(storage.TOKEN))==nil { return }
+	var until time.Time
+	if c.Policy.Remember!=expire.Never { until = time.Now().Add(c.Policy.Remember) }
+	c.HIS.HisRemember(msgid,until)
+}
 func (c *StorageWriter) findStorageClass(ngrps [][]byte, size int64) int {
 	for i,sm := range c.SM.Classes {
 		if sm==nil { continue }
@@ -106,38 +179,74 @@ func (c *StorageWriter) findStorageClass(ngrps [][]byte, size int64) int {
 func (c *StorageWriter) CheckPost() (possible bool) { return true }
 func (c *StorageWriter) CheckPostId(id []byte) (wanted bool, possible bool) {
 	tk := new(storage.TOKEN)
-	if c.HIS.HisLookup(id,tk)!=nil { return true,true }
+	if err := c.HIS.HisLookup(id,tk); err!=nil {
+		if err==storage.ERemembered { return false,true } /* Seen, but not stored. */
+		return true,true
+	}
 	ar,_,err := c.SM.Retrieve(tk, storage.SM_Stat)
 	if err!=nil { return true,true }
 	if ar!=nil  { ar.Release() }
 	return false,true
 }
 func (c *StorageWriter) PerformPost(id []byte, r *fastnntp.DotReader) (rejected bool, failed bool) {
-	hb := new(bytes.Buffer)
-	bb := new(bytes.Buffer)
-	ab := new(rBuffer)
-	sp := &iohelper.Splitter{
-		Head:hb,
-		Body:bb,
+	defer io.Copy(ioutil.Discard,r) /* Skip the rest of the article, if it is rejected early. */
+	
+	br := bufio.NewReaderSize(c.Limits.reader(r),stream_buffer)
+	hd,sep,err := readHeader(br,c.Limits)
+	if err==nil { err = c.Limits.checkHeader(hd) }
+	switch err {
+	case nil:
+	case ETooLarge,ELineTooLong,ETooManyHeaders:
+		c.reject(id,err)
+		return true,false
+	default:
+		if _,ok := err.(missingHeader); ok {
+			c.reject(id,err)
+			return true,false
+		}
+		return false,true /* Failed receiving the article. */
 	}
-	_,err := io.Copy(sp,r)
-	if err!=nil { return false,true } /* Failed receiving the article. */
 	
 	stamp := c.Stamp
 	if stamp==nil { stamp = noopstamp_inst }
 	
-	hi := posting.ParseAndProcessHeaderWithBuffer(id,stamp,hb.Bytes(),&ab.Buffer)
+	hi := posting.ParseAndProcessHeaderWithBuffer(id,stamp,hd,new(bytes.Buffer))
 	if hi==nil { return false,true }
 	
-	if len(hi.MessageId)==0 { return true,false } /* No article-id: rejected! */
+	if len(hi.MessageId)==0 { /* No article-id: rejected! */
+		c.reject(id,ENoMessageId)
+		return true,false
+	}
 	
 	ngrps := posting.SplitNewsgroups(hi.Newsgroups)
+	if err = c.Limits.checkGroups(ngrps); err!=nil {
+		c.reject(hi.MessageId,err)
+		c.remember(hi.MessageId)
+		return true,false
+	}
+	ngrps,err = c.filterGroups(ngrps)
+	if err!=nil {
+		c.reject(hi.MessageId,err)
+		return true,false
+	}
 	
-	// TODO: filter the groups for allowed/disallowed groups.
-	
-	if len(ngrps)==0 { return true,false } /* We need to be in at least one newsgroup. */
+	if len(ngrps)==0 { /* We need to be in at least one newsgroup. */
+		c.reject(hi.MessageId,ENoGroups)
+		c.remember(hi.MessageId)
+		return true,false
+	}
 	
-	//nums := make([]int64,len(ngrps))
+	/*
+	The body is streamed into the storage method. It is only spooled, if its
+	size must be known in advance.
+	*/
+	body,err := c.receiveBody(br,c.Filter!=nil || c.sizeMatters())
+	defer body.release()
+	if err==ETooLarge {
+		c.reject(hi.MessageId,err)
+		return true,false
+	}
+	if err!=nil { return false,true }
 	
 	tk := new(storage.TOKEN)
 	ove := new(storage.OverviewElement)
@@ -147,53 +256,101 @@ func (c *StorageWriter) PerformPost(id []byte, r *fastnntp.DotReader) (rejected
 	ove.Date    = hi.Date
 	ove.MsgId   = hi.MessageId
 	ove.Refs    = hi.References
-	ove.Lng     = int64(len(hi.RAW)+bb.Len())
-	ove.Lines   = posting.CountLines(bb.Bytes())
 	
-	bb.WriteTo(ab)
+	if c.Filter!=nil {
+		v,reason := c.Filter.Run(&ArticleInfo{
+			MessageId: hi.MessageId,
+			Head: hi.RAW,
+			Body: body.pre,
+			Groups: ngrps,
+			Bytes: int64(len(hi.RAW)+len(sep))+body.cnt.n,
+			Lines: body.cnt.lines,
+			Local: c.Local,
+		})
+		switch v {
+		case Reject:
+			c.reject(hi.MessageId,errors.New(reason))
+			c.remember(hi.MessageId)
+			return true,false
+		case Drop:
+			c.remember(hi.MessageId)
+			return false,false
+		}
+	}
 	
-	if c.HIS.HisLookup(hi.MessageId,tk)==nil { return true,false } /* Prevent Message-ID overwrites. */
+	/*
+	Unapproved articles to moderated groups are not stored. Local posts are
+	submitted to the moderator, articles from peers are rejected.
+	*/
+	if mgrp := c.unapproved(hi.RAW,ngrps); mgrp!=nil {
+		if !c.Local {
+			c.reject(hi.MessageId,EUnapproved)
+			return true,false
+		}
+		switch err = c.submit(mgrp,newStreamArticle(hi.RAW,sep,body.reader())); err {
+		case nil: return false,false
+		case ENoModerator:
+			c.reject(hi.MessageId,err)
+			return true,false
+		}
+		return false,true
+	}
 	
-	cls := c.findStorageClass(ngrps,ove.Lng)
-	if cls<0 { return false,true /* We didn't found a storage class: posting failed! */ }
+	switch c.HIS.HisLookup(hi.MessageId,tk) {
+	case nil,storage.ERemembered: /* Prevent Message-ID overwrites. */
+		c.reject(hi.MessageId,EDuplicate)
+		return true,false
+	}
 	
-	amd := c.article_md()
+	amd := c.article_md(hi.RAW,ngrps)
 	
-	tk[0] = byte(cls)
-	err = c.SM.Classes[cls].Store(amd,ab,tk)
-	if err!=nil { return false,true /* Storing the article failed with some IO error. Fail. */ }
+	txn := &postTxn{c: c, msgid: hi.MessageId, md: amd, tk: tk}
 	
-	err = c.HIS.HisWrite(hi.MessageId,amd,tk)
+	/*
+	The article numbers are assigned before the article is stored, so the
+	stored copy carries the correct Xref: header. Groups, that are unknown to
+	the overview database, are dropped.
+	*/
+	ngrps,err = txn.reserve(ngrps)
 	if err!=nil { return false,true }
+	if len(ngrps)==0 {
+		c.reject(hi.MessageId,ENoGroups)
+		return true,false
+	}
+	head := c.cancelLock(hi.RAW,hi.MessageId)
+	head = c.xref(head,ngrps,txn.nums)
 	
-	first := true
-	ri := c.RI
-	var rie *storage.RiElement
-	var riw storage.RiWriter
-	if ri!=nil {
-		rie = new(storage.RiElement)
-		riw = ri.RiBegin(hi.MessageId)
-	}
-	
-	for _,ngrp := range ngrps {
-		err = c.OV.GroupWriteOv(ngrp,true,amd,tk,ove)
-		
-		if riw==nil { continue } /* Short cut, if ri==nil, we don't need the further code. */
-		
-		rie.Group = ngrp
-		rie.Num   = ove.Num
-		if first {
-			err = riw.RiWrite(amd, rie)
-		} else {
-			err = riw.RiWriteMore(amd, rie)
-		}
-		first = false
+	/* If the size is not known yet, it doesn't matter for the storage class. */
+	cls := c.findStorageClass(ngrps,int64(len(head)+len(sep))+body.cnt.n)
+	if cls<0 { return false,true /* We didn't found a storage class: posting failed! */ }
+	
+	err = txn.store(cls,newStreamArticle(head,sep,body.reader()))
+	if err==ETooLarge {
+		c.reject(hi.MessageId,err)
+		return true,false
+	}
+	if err!=nil { return false,true /* Storing the article failed with some IO error. Fail. */ }
+	
+	/* The body has been counted while it was stored. */
+	ove.Lng     = int64(len(head)+len(sep))+body.cnt.n
+	ove.Lines   = body.cnt.lines
+	
+	err = txn.his()
+	if err==nil { err = txn.ov(ngrps,ove) }
+	if err==nil { err = txn.ri() }
+	if err!=nil {
+		txn.rollback()
+		return false,true
+	}
+	
+	/* Control messages with bodies too large to be kept in memory are processed without body. */
+	if body.mem {
+		c.control(head,body.pre)
+	} else {
+		c.control(head,nil)
 	}
-	err = riw.RiCommit()
 	
 	/* Success! */
 	return false,false
 }
 
-
-
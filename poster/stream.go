@@ -0,0 +1,167 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// Size of the read buffer. Bodies up to this size are kept in memory.
+	stream_buffer = 64<<10
+	
+	// Maximum size of the header of an article.
+	max_header = 1<<20
+)
+
+/*
+Reads the header of an article, line by line. sep is the empty line, that
+separates the header from the body (empty, if there is no body).
+*/
+func readHeader(br *bufio.Reader, lm *Limits) (head, sep []byte, err error) {
+	for {
+		var line []byte
+		for {
+			frag,e := br.ReadSlice('\n')
+			line = append(line,frag...)
+			if e==bufio.ErrBufferFull && len(head)+len(line)<=max_header { continue }
+			err = e
+			break
+		}
+		if err==bufio.ErrBufferFull { return nil,nil,ETooLarge }
+		
+		if len(bytes.TrimRight(line,"\r\n"))==0 {
+			/* The empty line, or the end of the article. */
+			sep = line
+			if err==io.EOF { err = nil }
+			return
+		}
+		if lm!=nil && lm.MaxLineLength>0 && len(bytes.TrimRight(line,"\r\n"))>lm.MaxLineLength {
+			return nil,nil,ELineTooLong
+		}
+		head = append(head,line...)
+		if len(head)>max_header { return nil,nil,ETooLarge }
+		if err==io.EOF { return head,nil,nil }
+		if err!=nil { return }
+	}
+}
+
+/*
+Counts the bytes and lines of the body, as it is read.
+*/
+type bodyCounter struct {
+	r     io.Reader
+	n     int64
+	lines int64
+}
+
+func (b *bodyCounter) Read(p []byte) (n int, err error) {
+	n,err = b.r.Read(p)
+	b.n += int64(n)
+	b.lines += int64(bytes.Count(p[:n],[]byte("\n")))
+	return
+}
+
+/*
+The body of an incoming article. Small bodies are kept in memory. Large bodies
+are spooled into a temporary file, if their size must be known before they are
+stored. Otherwise they are streamed into the storage method directly.
+*/
+type articleBody struct {
+	cnt   bodyCounter
+	
+	// The body or, for large bodies, its first part.
+	pre   []byte
+	
+	// Reports, whether the size and lines are known before storing.
+	known bool
+	
+	mem   bool
+	file  *os.File
+}
+
+func (c *StorageWriter) receiveBody(br *bufio.Reader, spool bool) (b *articleBody, err error) {
+	b = &articleBody{cnt: bodyCounter{r: br}}
+	p,err := br.Peek(stream_buffer)
+	b.pre = append([]byte(nil),p...)
+	switch err {
+	case io.EOF:
+		/* The body fits into memory. */
+		_,err = io.Copy(ioutil.Discard,&b.cnt)
+		b.known,b.mem = true,true
+		return
+	case nil:
+	default: return
+	}
+	if !spool { return }
+	
+	b.file,err = ioutil.TempFile(c.TempDir,"article-")
+	if err!=nil { return }
+	_,err = io.Copy(b.file,&b.cnt)
+	if err==nil { _,err = b.file.Seek(0,io.SeekStart) }
+	b.known = true
+	return
+}
+
+// Returns a reader for the body. Must be called only once.
+func (b *articleBody) reader() io.Reader {
+	switch {
+	case b.mem: return bytes.NewReader(b.pre)
+	case b.file!=nil: return b.file
+	}
+	return &b.cnt
+}
+
+func (b *articleBody) release() {
+	if b.file==nil { return }
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
+
+/*
+An article, that is streamed into a StorageMethod.
+*/
+type streamArticle struct {
+	r io.Reader
+}
+
+func newStreamArticle(head, sep []byte, body io.Reader) *streamArticle {
+	return &streamArticle{io.MultiReader(bytes.NewReader(head),bytes.NewReader(sep),body)}
+}
+
+func (s *streamArticle) Release() {}
+func (s *streamArticle) Read(p []byte) (int, error) { return s.r.Read(p) }
+func (s *streamArticle) WriteTo(w io.Writer) (int64, error) { return io.Copy(w,s.r) }
+
+// Reports, whether the storage class of an article depends on its size.
+func (c *StorageWriter) sizeMatters() bool {
+	for i,sm := range c.SM.Classes {
+		if sm==nil { continue }
+		if mt := c.SM.Methods[i]; mt!=nil && (mt.Size>0 || mt.MaxSize>0) { return true }
+	}
+	return false
+}
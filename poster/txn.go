@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+)
+
+/*
+A posting transaction across SM, HIS, OV and RI.
+Each step records, what has to be undone, if a later step fails.
+*/
+type postTxn struct {
+	c     *StorageWriter
+	msgid []byte
+	md    *storage.Article_MD
+	tk    *storage.TOKEN
+	
+	stored bool
+	inHis  bool
+	
+	// The article numbers. The Overview lines are written, if grps is not nil.
+	grps   [][]byte
+	nums   []int64
+}
+
+func (t *postTxn) store(cls int, a storage.Article_W) (err error) {
+	t.tk[0] = byte(cls)
+	err = t.c.SM.Classes[cls].Store(t.md,a,t.tk)
+	t.stored = err==nil
+	return
+}
+
+func (t *postTxn) his() (err error) {
+	err = t.c.HIS.HisWrite(t.msgid,t.md,t.tk)
+	t.inHis = err==nil
+	return
+}
+
+/*
+Assigns the article numbers, before the article is stored. Groups without
+stats-record in the overview database are skipped; the remaining groups are
+returned.
+*/
+func (t *postTxn) reserve(grps [][]byte) (known [][]byte, err error) {
+	known = make([][]byte,0,len(grps))
+	for _,grp := range grps {
+		if _,_,_,err1 := t.c.OV.GroupStat(grp); err1==nil { known = append(known,grp) }
+	}
+	if len(known)==0 { return }
+	nums := make([]int64,len(known))
+	err = t.c.OV.GroupReserveNums(known,nums)
+	if err==nil { t.nums = nums }
+	return
+}
+
+func (t *postTxn) ov(grps [][]byte, ove *storage.OverviewElement) (err error) {
+	nums := t.nums
+	autonum := nums==nil
+	if autonum { nums = make([]int64,len(grps)) }
+	err = t.c.OV.GroupWriteOvBatch(grps,autonum,t.md,t.tk,ove,nums)
+	if err==nil { t.grps,t.nums = grps,nums }
+	return
+}
+
+func (t *postTxn) ri() (err error) {
+	if t.c.RI==nil { return }
+	riw := t.c.RI.RiBegin(t.msgid)
+	if riw==nil { return }
+	rie := new(storage.RiElement)
+	for i,grp := range t.grps {
+		rie.Group = grp
+		rie.Num   = t.nums[i]
+		if i==0 {
+			err = riw.RiWrite(t.md,rie)
+		} else {
+			err = riw.RiWriteMore(t.md,rie)
+		}
+		if err!=nil { return }
+	}
+	return riw.RiCommit()
+}
+
+// Undoes the completed steps in reverse order.
+func (t *postTxn) rollback() {
+	for i,grp := range t.grps {
+		t.c.OV.CancelOv(grp,t.nums[i])
+	}
+	if t.inHis { t.c.HIS.HisCancel(t.msgid) }
+	if t.stored { t.c.SM.Cancel(t.tk) }
+	*t = postTxn{c: t.c}
+}
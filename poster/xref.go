@@ -0,0 +1,56 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package poster
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+	
+	"bytes"
+	"os"
+	"strconv"
+)
+
+func (c *StorageWriter) server() string {
+	if c.Server!="" { return c.Server }
+	host,err := os.Hostname()
+	if err!=nil || host=="" { host = "localhost" }
+	return host
+}
+
+/*
+Returns a copy of head with an Xref: header listing each group:number pair.
+Existing Xref: headers are removed.
+*/
+func (c *StorageWriter) xref(head []byte, grps [][]byte, nums []int64) []byte {
+	nl := []byte("\n")
+	if bytes.Contains(head,[]byte("\r\n")) { nl = []byte("\r\n") }
+	
+	h := header.Remove(head,[]byte("Xref"))
+	if len(h)>0 && h[len(h)-1]!='\n' { h = append(h,nl...) }
+	h = append(append(h,"Xref: "...),c.server()...)
+	for i,grp := range grps {
+		h = append(append(append(h,' '),grp...),':')
+		h = strconv.AppendInt(h,nums[i],10)
+	}
+	return append(h,nl...)
+}
@@ -0,0 +1,313 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+A Bloom filter in front of a HisMethod.
+
+Most message-ids offered to a transit server are unknown. The filter answers
+those definite misses without touching the database.
+
+The filter is persisted as a snapshot file plus a journal of message-ids
+added since the last snapshot, so no message-id is lost after a crash.
+*/
+package hisbloom
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+var EMiss = errors.New("not in history (filter)")
+var ENoWalker = errors.New("history can't be enumerated")
+var eBadSnapshot = errors.New("bad bloom filter snapshot")
+
+var bin = binary.LittleEndian
+
+var magic = [4]byte{'H','B','F','1'}
+
+type bloom struct {
+	bits []uint64
+	k    uint32
+}
+
+func newBloom(n int, p float64) *bloom {
+	if n<1 { n = 1 }
+	if p<=0 || p>=1 { p = 0.01 }
+	m := math.Ceil(-float64(n)*math.Log(p)/(math.Ln2*math.Ln2))
+	k := uint32(math.Round(m/float64(n)*math.Ln2))
+	if k<1 { k = 1 }
+	return &bloom{bits: make([]uint64,(uint64(m)+63)/64), k: k}
+}
+
+func (b *bloom) hash(msgid []byte) (h1, h2 uint64) {
+	ha := fnv.New64a()
+	ha.Write(msgid)
+	h := ha.Sum64()
+	return h&0xffffffff,(h>>32)|1
+}
+
+func (b *bloom) add(msgid []byte) {
+	h1,h2 := b.hash(msgid)
+	m := uint64(len(b.bits))*64
+	for i := uint64(0); i<uint64(b.k); i++ {
+		j := (h1+i*h2)%m
+		b.bits[j/64] |= 1<<(j%64)
+	}
+}
+
+func (b *bloom) has(msgid []byte) bool {
+	h1,h2 := b.hash(msgid)
+	m := uint64(len(b.bits))*64
+	for i := uint64(0); i<uint64(b.k); i++ {
+		j := (h1+i*h2)%m
+		if b.bits[j/64]&(1<<(j%64))==0 { return false }
+	}
+	return true
+}
+
+/*
+A HisMethod, that consults a Bloom filter before the underlying HisMethod.
+*/
+type Filter struct {
+	storage.HisMethod
+	
+	// The snapshot file. If empty, the filter is not persisted.
+	Path string
+	
+	mu      sync.RWMutex
+	b       *bloom
+	n       int
+	p       float64
+	journal *os.File
+}
+
+var _ storage.HisMethod = (*Filter)(nil)
+
+/*
+Creates an empty filter for n message-ids with the false-positive rate p.
+The filter must be filled using Rebuild or Load before it is used.
+*/
+func New(his storage.HisMethod, n int, p float64) *Filter {
+	return &Filter{HisMethod: his, b: newBloom(n,p), n: n, p: p}
+}
+
+/*
+Opens a persisted filter at path. If there is no (valid) snapshot, the filter
+is rebuilt from the history.
+*/
+func Open(his storage.HisMethod, path string, n int, p float64) (f *Filter, err error) {
+	f = New(his,n,p)
+	f.Path = path
+	if f.Load()!=nil {
+		err = f.Rebuild()
+		if err!=nil { return nil,err }
+	}
+	
+	/* Fold the journals into a fresh snapshot. */
+	err = f.Save()
+	if err!=nil { return nil,err }
+	f.journal,err = os.OpenFile(path+".journal",os.O_WRONLY|os.O_CREATE|os.O_APPEND,0600)
+	if err!=nil { return nil,err }
+	return
+}
+
+func (f *Filter) add(msgid []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.b.add(msgid)
+	if f.journal!=nil {
+		f.journal.Write(append(append(make([]byte,0,len(msgid)+1),msgid...),'\n'))
+	}
+}
+
+// Reports, whether the message-id may be in the history. If false, it is definitely not.
+func (f *Filter) Has(msgid []byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.b.has(msgid)
+}
+
+/*
+Rebuilds the filter from the underlying HisMethod, which must implement storage.HisWalker.
+*/
+func (f *Filter) Rebuild() (err error) {
+	w,ok := f.HisMethod.(storage.HisWalker)
+	if !ok { return ENoWalker }
+	b := newBloom(f.n,f.p)
+	err = w.HisWalk(func(msgid []byte) error {
+		b.add(msgid)
+		return nil
+	})
+	if err!=nil { return }
+	f.mu.Lock()
+	f.b = b
+	f.mu.Unlock()
+	return
+}
+
+func readSnapshot(name string) (b *bloom, err error) {
+	var fh *os.File
+	fh,err = os.Open(name)
+	if err!=nil { return }
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	
+	var hdr [16]byte
+	_,err = io.ReadFull(r,hdr[:])
+	if err!=nil { return }
+	if !bytes.Equal(hdr[:4],magic[:]) { return nil,eBadSnapshot }
+	b = &bloom{k: bin.Uint32(hdr[4:])}
+	nw := bin.Uint64(hdr[8:])
+	if b.k==0 || nw==0 { return nil,eBadSnapshot }
+	b.bits = make([]uint64,nw)
+	err = binary.Read(r,bin,b.bits)
+	if err!=nil { return nil,err }
+	return
+}
+
+func replay(b *bloom, name string) error {
+	fh,err := os.Open(name)
+	if os.IsNotExist(err) { return nil }
+	if err!=nil { return err }
+	defer fh.Close()
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		if len(sc.Bytes())!=0 { b.add(sc.Bytes()) }
+	}
+	return sc.Err()
+}
+
+/*
+Loads the snapshot at Path and replays the journal.
+*/
+func (f *Filter) Load() (err error) {
+	b,err := readSnapshot(f.Path)
+	if err!=nil { return }
+	err = replay(b,f.Path+".journal.old")
+	if err==nil { err = replay(b,f.Path+".journal") }
+	if err!=nil { return }
+	f.mu.Lock()
+	f.b = b
+	f.mu.Unlock()
+	return
+}
+
+/*
+Writes a snapshot to Path and starts a new journal.
+*/
+func (f *Filter) Save() (err error) {
+	if f.Path=="" { return }
+	jn := f.Path+".journal"
+	jo := f.Path+".journal.old"
+	
+	/*
+	Copy the filter and rotate the journal in one step. Until the snapshot
+	is written, the old journal is kept for replay.
+	*/
+	f.mu.Lock()
+	b := &bloom{bits: append([]uint64(nil),f.b.bits...), k: f.b.k}
+	if f.journal!=nil {
+		f.journal.Close()
+		f.journal = nil
+		err = os.Rename(jn,jo)
+		if err==nil { f.journal,err = os.OpenFile(jn,os.O_WRONLY|os.O_CREATE|os.O_TRUNC,0600) }
+	}
+	f.mu.Unlock()
+	if err!=nil { return }
+	
+	tmp := f.Path+".tmp"
+	var fh *os.File
+	fh,err = os.OpenFile(tmp,os.O_WRONLY|os.O_CREATE|os.O_TRUNC,0600)
+	if err!=nil { return }
+	w := bufio.NewWriter(fh)
+	var hdr [16]byte
+	copy(hdr[:],magic[:])
+	bin.PutUint32(hdr[4:],b.k)
+	bin.PutUint64(hdr[8:],uint64(len(b.bits)))
+	w.Write(hdr[:])
+	err = binary.Write(w,bin,b.bits)
+	if err==nil { err = w.Flush() }
+	if err==nil { err = fh.Sync() }
+	if e := fh.Close(); err==nil { err = e }
+	if err==nil { err = os.Rename(tmp,f.Path) }
+	if err==nil {
+		err = os.Remove(jo)
+		if os.IsNotExist(err) { err = nil }
+	}
+	return
+}
+
+/*
+Saves the filter every interval, until ctx is cancelled.
+*/
+func (f *Filter) Persist(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			f.Save()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Saves the filter and closes the journal. The underlying HisMethod is not closed.
+func (f *Filter) Close() (err error) {
+	err = f.Save()
+	f.mu.Lock()
+	if f.journal!=nil {
+		if e := f.journal.Close(); err==nil { err = e }
+		f.journal = nil
+	}
+	f.mu.Unlock()
+	return
+}
+
+func (f *Filter) HisWrite(msgid []byte,md *storage.Article_MD, t *storage.TOKEN) (err error) {
+	f.add(msgid)
+	return f.HisMethod.HisWrite(msgid,md,t)
+}
+func (f *Filter) HisLookup(msgid []byte, t *storage.TOKEN) (err error) {
+	if !f.Has(msgid) { return EMiss }
+	return f.HisMethod.HisLookup(msgid,t)
+}
+func (f *Filter) HisQuery(msgid []byte, md *storage.Article_MD, t *storage.TOKEN) (err error) {
+	if !f.Has(msgid) { return EMiss }
+	return f.HisMethod.HisQuery(msgid,md,t)
+}
+func (f *Filter) HisRemember(msgid []byte, until time.Time) (err error) {
+	f.add(msgid)
+	return f.HisMethod.HisRemember(msgid,until)
+}
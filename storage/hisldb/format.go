@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package hisldb
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"encoding/binary"
+	"time"
+)
+
+/*
+Record formats:
+
+	TOKEN                                 (34 bytes) An article (legacy, no times).
+	TOKEN + int64 arrival + int64 expires (50 bytes) An article.
+	'T' + int64 until                     (9 bytes)  A tombstone. until is in unix-seconds, 0 = forever.
+
+All times are in unix-seconds. 0 means unknown (or zero).
+*/
+const (
+	r_tomb = 'T'
+	
+	len_token = len(storage.TOKEN{})
+	len_art   = len_token+16
+	len_tomb  = 9
+)
+
+var bin = binary.BigEndian
+
+func tombRec(until time.Time) []byte {
+	rec := make([]byte,len_tomb)
+	rec[0] = r_tomb
+	bin.PutUint64(rec[1:],unix(until))
+	return rec
+}
+
+func isTomb(rec []byte) bool {
+	return len(rec)==len_tomb && rec[0]==r_tomb
+}
+
+// Reports, whether the tombstone rec has expired at ow.
+func tombExpired(rec []byte, ow time.Time) bool {
+	u := int64(bin.Uint64(rec[1:]))
+	return u!=0 && u<=ow.Unix()
+}
+
+func unix(t time.Time) uint64 {
+	if t.IsZero() { return 0 }
+	return uint64(t.Unix())
+}
+func fromUnix(u uint64) time.Time {
+	if u==0 { return time.Time{} }
+	return time.Unix(int64(u),0)
+}
+
+func artRec(md *storage.Article_MD, t *storage.TOKEN) []byte {
+	rec := make([]byte,len_art)
+	copy(rec,t[:])
+	if md!=nil {
+		bin.PutUint64(rec[len_token:],unix(md.Arrival))
+		bin.PutUint64(rec[len_token+8:],unix(md.Expires))
+	}
+	return rec
+}
+
+// Decodes an article record. md may be nil.
+func artDecode(rec []byte, md *storage.Article_MD, t *storage.TOKEN) bool {
+	switch len(rec) {
+	case len_token,len_art:
+	default: return false
+	}
+	copy(t[:],rec)
+	if md!=nil {
+		*md = storage.Article_MD{}
+		if len(rec)==len_art {
+			md.Arrival = fromUnix(bin.Uint64(rec[len_token:]))
+			md.Expires = fromUnix(bin.Uint64(rec[len_token+8:]))
+		}
+	}
+	return true
+}
+
+// Returns the arrival time of an article record (zero, if unknown).
+func artArrival(rec []byte) time.Time {
+	if len(rec)!=len_art { return time.Time{} }
+	return fromUnix(bin.Uint64(rec[len_token:]))
+}
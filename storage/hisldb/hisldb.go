@@ -32,6 +32,7 @@ import (
 	"github.com/byte-mug/fastnntp-backend2/storage"
 	"errors"
 	"path/filepath"
+	"time"
 )
 
 var eTokenMismatch = errors.New("internal Error: Token mismatch.")
@@ -41,21 +42,81 @@ type HisLdb struct {
 }
 
 var _ storage.HisMethod = (*HisLdb)(nil)
+var _ storage.HisWalker = (*HisLdb)(nil)
 
 func (s *HisLdb) HisWrite(msgid []byte,md *storage.Article_MD, t *storage.TOKEN) (err error) {
-	return s.DB.Put(msgid,t[:],nil)
+	return s.DB.Put(msgid,artRec(md,t),nil)
 }
 func (s *HisLdb) HisLookup(msgid []byte, t *storage.TOKEN) (err error) {
+	return s.HisQuery(msgid,nil,t)
+}
+func (s *HisLdb) HisQuery(msgid []byte, md *storage.Article_MD, t *storage.TOKEN) (err error) {
 	var rec []byte
 	rec,err = s.DB.Get(msgid,nil)
-	copy(t[:],rec)
-	if err==nil && len(t)!=len(rec) { err = eTokenMismatch }
+	if err!=nil { return }
+	if isTomb(rec) {
+		if tombExpired(rec,time.Now()) { return leveldb.ErrNotFound }
+		return storage.ERemembered
+	}
+	if !artDecode(rec,md,t) { err = eTokenMismatch }
 	return
 }
 func (s *HisLdb) HisCancel(msgid []byte) (err error) {
 	err = s.DB.Delete(msgid,nil)
 	return
 }
+func (s *HisLdb) HisRemember(msgid []byte, until time.Time) (err error) {
+	return s.DB.Put(msgid,tombRec(until),nil)
+}
+func (s *HisLdb) HisExpireRemembered(ow time.Time) (n int64, err error) {
+	iter := s.DB.NewIterator(nil,nil)
+	defer iter.Release()
+	bat := new(leveldb.Batch)
+	for iter.Next() {
+		if !isTomb(iter.Value()) || !tombExpired(iter.Value(),ow) { continue }
+		bat.Delete(iter.Key())
+		n++
+		if bat.Len()>=1024 {
+			err = s.DB.Write(bat,nil)
+			if err!=nil { return }
+			bat.Reset()
+		}
+	}
+	err = iter.Error()
+	if err==nil && bat.Len()>0 { err = s.DB.Write(bat,nil) }
+	return
+}
+
+func (s *HisLdb) HisPurge(ow time.Time) (n int64, err error) {
+	iter := s.DB.NewIterator(nil,nil)
+	defer iter.Release()
+	bat := new(leveldb.Batch)
+	for iter.Next() {
+		a := artArrival(iter.Value())
+		if a.IsZero() || !a.Before(ow) { continue }
+		bat.Delete(iter.Key())
+		n++
+		if bat.Len()>=1024 {
+			err = s.DB.Write(bat,nil)
+			if err!=nil { return }
+			bat.Reset()
+		}
+	}
+	err = iter.Error()
+	if err==nil && bat.Len()>0 { err = s.DB.Write(bat,nil) }
+	return
+}
+
+func (s *HisLdb) HisWalk(f func(msgid []byte) error) (err error) {
+	iter := s.DB.NewIterator(nil,nil)
+	defer iter.Release()
+	for iter.Next() {
+		err = f(iter.Key())
+		if err!=nil { return }
+	}
+	err = iter.Error()
+	return
+}
 
 func OpenSpoolHisLdb(spool string, o *opt.Options) (*HisLdb,error) {
 	db,err := leveldb.OpenFile(filepath.Join(spool,"hisldb"), o)
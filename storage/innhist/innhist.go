@@ -0,0 +1,223 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+Import and export of INN text history files.
+
+Each line of an INN history file has the form
+
+	[HASH]<TAB>arrived~expires~posted<TAB>@TOKEN@
+
+HASH is the MD5 hash of the message-id, the times are in unix-seconds (expires
+is "-" if unknown) and the token is hex-encoded. Lines of remembered
+(not stored) articles lack the token.
+
+Since INN's history only contains hashes, the message-id of an imported line
+is read from the article. Lines, whose article is not available, are skipped.
+*/
+package innhist
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"github.com/byte-mug/fastnntp-backend2/iohelper"
+	"github.com/byte-mug/fastnntp-backend2/utils/header"
+	
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+var ENoWalker = errors.New("history can't be enumerated")
+
+var bin = binary.BigEndian
+
+/*
+Computes INN's hash of a message-id. The part after the '@' is case-insensitive.
+*/
+func Hash(msgid []byte) string {
+	m := append([]byte(nil),msgid...)
+	if i := bytes.IndexByte(m,'@'); i>=0 {
+		copy(m[i:],bytes.ToLower(m[i:]))
+	}
+	sum := md5.Sum(m)
+	return "["+fmt.Sprintf("%X",sum[:])+"]"
+}
+
+/*
+Maps a decoded INN token to a storage token. Returns false, if the token can't be mapped.
+*/
+type TokenMapper func(inn []byte, t *storage.TOKEN) bool
+
+/*
+Maps tokens in our own format, as written by Export.
+*/
+func Native(inn []byte, t *storage.TOKEN) bool {
+	if len(inn)!=len(t) { return false }
+	copy(t[:],inn)
+	return true
+}
+
+/*
+Returns a mapper for INN timehash tokens of the storage type typ.
+The INN token carries the arrival time (4 bytes) and a sequence number (2 bytes).
+
+INN names the files time-nn/bb/cc/yyyy-aadd, timehash names them
+time-nn/zzbb/cc/yyyy-aadd, so the bb directories must be moved to 00bb.
+*/
+func TimeHash(typ byte) TokenMapper {
+	return func(inn []byte, t *storage.TOKEN) bool {
+		if len(inn)!=18 || inn[0]!=typ { return false }
+		t[0] = inn[1]
+		t[1] = 0
+		b := t.Bytes()
+		storage.Bzero(b)
+		bin.PutUint64(b,uint64(bin.Uint32(inn[2:])))
+		bin.PutUint32(b[8:],uint32(bin.Uint16(inn[6:])))
+		return true
+	}
+}
+
+/*
+Statistics of an import.
+*/
+type ImportStats struct {
+	Lines    int64
+	Imported int64
+	
+	// Lines without a token (remembered articles) or with an unmapped token.
+	NoToken int64
+	
+	// Lines, whose article could not be read or has a different message-id.
+	NoArticle int64
+	
+	Failed    int64
+	LastError error
+}
+
+func parseTime(s string) (t time.Time, err error) {
+	if s=="-" || s=="" { return }
+	var u int64
+	u,err = strconv.ParseInt(s,10,64)
+	if err==nil && u!=0 { t = time.Unix(u,0) }
+	return
+}
+
+// Reads the Message-ID of the article t.
+func messageId(sm *storage.StorageManager, t *storage.TOKEN, buf *bytes.Buffer) []byte {
+	obj,_,err := sm.Retrieve(t,storage.SM_Head)
+	if err!=nil { return nil }
+	defer obj.Release()
+	buf.Reset()
+	_,err = obj.WriteTo(&iohelper.Splitter{Head: buf, Body: ioutil.Discard})
+	if err!=nil { return nil }
+	return header.Get(buf.Bytes(),[]byte("Message-ID"))
+}
+
+/*
+Imports an INN history file into his. The tokens are mapped using the given
+mappers, in order. The articles are read from sm to obtain their message-ids.
+*/
+func Import(r io.Reader, his storage.HisMethod, sm *storage.StorageManager, mappers ...TokenMapper) (st ImportStats, err error) {
+	sc := bufio.NewScanner(r)
+	tk := new(storage.TOKEN)
+	md := new(storage.Article_MD)
+	buf := new(bytes.Buffer)
+	for sc.Scan() {
+		st.Lines++
+		f := bytes.Split(sc.Bytes(),[]byte("\t"))
+		if len(f)<2 || len(f[0])!=34 {
+			return st,fmt.Errorf("history:%d: malformed line",st.Lines)
+		}
+		tm := bytes.Split(f[1],[]byte("~"))
+		*md = storage.Article_MD{}
+		md.Arrival,err = parseTime(string(tm[0]))
+		if err==nil && len(tm)>1 { md.Expires,err = parseTime(string(tm[1])) }
+		if err!=nil { return st,fmt.Errorf("history:%d: %v",st.Lines,err) }
+		
+		if len(f)<3 || len(f[2])<2 {
+			st.NoToken++
+			continue
+		}
+		inn,e := hex.DecodeString(string(bytes.Trim(f[2],"@")))
+		mapped := false
+		if e==nil {
+			for _,m := range mappers {
+				if m(inn,tk) { mapped = true; break }
+			}
+		}
+		if !mapped {
+			st.NoToken++
+			continue
+		}
+		
+		msgid := messageId(sm,tk,buf)
+		if len(msgid)==0 || Hash(msgid)!=string(f[0]) {
+			st.NoArticle++
+			continue
+		}
+		
+		if e := his.HisWrite(msgid,md,tk); e!=nil {
+			st.Failed++
+			st.LastError = e
+			continue
+		}
+		st.Imported++
+	}
+	err = sc.Err()
+	return
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() { return "-" }
+	return strconv.FormatInt(t.Unix(),10)
+}
+
+/*
+Exports his to an INN history file. his must implement storage.HisWalker.
+
+Tombstones are not exported. The posting time is not kept, so the arrival
+time is written instead. The tokens are written in our own format (see Native).
+*/
+func Export(w io.Writer, his storage.HisMethod) (err error) {
+	hw,ok := his.(storage.HisWalker)
+	if !ok { return ENoWalker }
+	bw := bufio.NewWriter(w)
+	tk := new(storage.TOKEN)
+	md := new(storage.Article_MD)
+	err = hw.HisWalk(func(msgid []byte) error {
+		if his.HisQuery(msgid,md,tk)!=nil { return nil } /* Tombstone or gone. */
+		arr := formatTime(md.Arrival)
+		if md.Arrival.IsZero() { arr = "0" }
+		_,err := fmt.Fprintf(bw,"%s\t%s~%s~%s\t@%X@\n",Hash(msgid),arr,formatTime(md.Expires),arr,tk[:])
+		return err
+	})
+	if err==nil { err = bw.Flush() }
+	return
+}
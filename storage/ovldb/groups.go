@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ovldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+Returns the key range, that contains all records of the group grp.
+*/
+func recrange(kf OvKeyFormat, grp []byte) *util.Range {
+	lid := kf.recid(grp,-1)
+	kf.recid_incr(lid)
+	return &util.Range{Start: kf.recid(grp,0), Limit: lid}
+}
+
+/*
+Deletes all keys within rng. The deletions are committed in chunks.
+*/
+func (ov *OvLDB) deleteRange(rng *util.Range) (err error) {
+	bat := new(leveldb.Batch)
+	iter := ov.DB.NewIterator(rng,nil)
+	for iter.Next() {
+		bat.Delete(iter.Key())
+		if bat.Len()>=migrate_batch {
+			err = ov.DB.Write(bat,nil)
+			if err!=nil { iter.Release(); return }
+			bat.Reset()
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err!=nil { return }
+	return ov.DB.Write(bat,nil)
+}
+
+func (ov *OvLDB) RemoveGroup(grp []byte) (err error) {
+	defer ov.lock_group(grp)()
+	kf,_ := ov.formats(grp)
+	
+	mrid := kf.gstatid(grp)
+	rng := recrange(kf,grp)
+	_,err = ov.DB.Get(mrid,nil)
+	if err!=nil { return }
+	
+	/* Remove the stats-record first, so the group disappears at once. */
+	bat := new(leveldb.Batch)
+	bat.Delete(mrid)
+	f,isv2 := kf.(*ovf2)
+	if isv2 { bat.Delete(gidkey(grp)) }
+	err = ov.DB.Write(bat,nil)
+	if isv2 { f.forget(grp) }
+	if err!=nil { return }
+	
+	/* The records are orphaned now; remove them. */
+	return ov.deleteRange(rng)
+}
+
+func (ov *OvLDB) RenameGroup(oldgrp, newgrp []byte) (err error) {
+	defer ov.lock_groups(oldgrp,newgrp)()
+	kf,_ := ov.formats(oldgrp)
+	nkf,_ := ov.formats(newgrp)
+	
+	mrid := kf.gstatid(oldgrp)
+	mrec,err := ov.DB.Get(mrid,nil)
+	if err!=nil { return }
+	
+	_,err = ov.DB.Get(nkf.gstatid(newgrp),nil)
+	if err==nil { return eGroupExists }
+	if err!=leveldb.ErrNotFound { return }
+	
+	/* In the V2 format, renaming a group is a matter of reassigning its group-id. */
+	if f,ok := kf.(*ovf2); ok {
+		id := f.gid(oldgrp)
+		bat := new(leveldb.Batch)
+		bat.Delete(gidkey(oldgrp))
+		f.assign(bat,newgrp,id)
+		err = ov.DB.Write(bat,nil)
+		f.forget(oldgrp)
+		if err==nil { f.published(newgrp,id) }
+		return
+	}
+	
+	/*
+	In the V1 format, every record has to be rewritten. The new records are
+	written first, then the group is switched over, then the old records are
+	removed.
+	*/
+	bat := new(leveldb.Batch)
+	iter := ov.DB.NewIterator(recrange(kf,oldgrp),nil)
+	for iter.Next() {
+		bat.Put(kf.recid(newgrp,kf.recid2num(iter.Key())),iter.Value())
+		if bat.Len()>=migrate_batch {
+			err = ov.DB.Write(bat,nil)
+			if err!=nil { iter.Release(); return }
+			bat.Reset()
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err!=nil { return }
+	bat.Put(kf.gstatid(newgrp),mrec)
+	bat.Delete(mrid)
+	err = ov.DB.Write(bat,nil)
+	if err!=nil { return }
+	
+	return ov.deleteRange(recrange(kf,oldgrp))
+}
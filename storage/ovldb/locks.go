@@ -0,0 +1,291 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ovldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"sync"
+	"sync/atomic"
+	"sort"
+	"bytes"
+)
+
+/*
+Per-group lock and cached group statistics.
+
+Writers of new Overview lines (GroupWriteOv, GroupWriteOvBatch) only take the
+read lock and assign article numbers using atomic operations on the cached
+statistics, so concurrent writers to the same group don't serialize on each
+other. All other write operations take the exclusive lock.
+
+The stats-record is written under wmu, together with the Overview line, so the
+records are stored in order and the stored count matches the Overview lines.
+*/
+type groupLock struct {
+	sync.RWMutex
+	lmu    sync.Mutex
+	wmu    sync.Mutex
+	loaded int32
+	
+	// Cached statistics; valid if loaded!=0.
+	num, low, high int64
+	
+	// Number of holders and waiters; guarded by the shard mutex.
+	refs int
+}
+
+/*
+Loads the cached statistics, if necessary. The caller must hold the read lock.
+
+Numbers assigned by GroupReserveNums are not recorded in the stats-record, so
+the stored high water-mark may lag behind. It is corrected using the last
+record of the group.
+*/
+func (gl *groupLock) load(ov *OvLDB, kf OvKeyFormat, vf OvValFormat, grp []byte) (err error) {
+	if atomic.LoadInt32(&gl.loaded)!=0 { return }
+	gl.lmu.Lock()
+	defer gl.lmu.Unlock()
+	if atomic.LoadInt32(&gl.loaded)!=0 { return }
+	
+	rec,err := ov.DB.Get(kf.gstatid(grp),nil)
+	if err!=nil { return }
+	num,low,high,err := vf.explodeGstat(rec)
+	if err!=nil { return }
+	
+	iter := ov.DB.NewIterator(recrange(kf,grp),nil)
+	if iter.Last() {
+		if n := kf.recid2num(iter.Key()); high<n { high = n }
+	}
+	iter.Release()
+	
+	atomic.StoreInt64(&gl.num,num)
+	atomic.StoreInt64(&gl.low,low)
+	atomic.StoreInt64(&gl.high,high)
+	atomic.StoreInt32(&gl.loaded,1)
+	return
+}
+
+/*
+Raises the high water-mark to at least n.
+*/
+func (gl *groupLock) raise(n int64) {
+	for {
+		high := atomic.LoadInt64(&gl.high)
+		if high>=n || atomic.CompareAndSwapInt64(&gl.high,high,n) { return }
+	}
+}
+
+/*
+Reverts addOv() after a failed write. The number is given back, unless it has
+already been superseded by a concurrent writer.
+*/
+func (gl *groupLock) unadd(autonum bool, n int64) {
+	if autonum { atomic.CompareAndSwapInt64(&gl.high,n,n-1) }
+}
+
+func (gl *groupLock) gstat(vf OvValFormat) []byte {
+	return vf.joinGstat(make([]byte,32),atomic.LoadInt64(&gl.num),atomic.LoadInt64(&gl.low),atomic.LoadInt64(&gl.high))
+}
+
+/*
+Writes the cached statistics back and invalidates them. Called with the
+exclusive lock held, so the other operations can rely on the stored
+stats-record.
+*/
+func (gl *groupLock) flush(ov *OvLDB, grp []byte) {
+	if atomic.LoadInt32(&gl.loaded)==0 { return }
+	atomic.StoreInt32(&gl.loaded,0)
+	kf,vf := ov.formats(grp)
+	ov.DB.Put(kf.gstatid(grp),gl.gstat(vf),nil)
+}
+
+const lock_shards = 64
+
+type lockShard struct {
+	mu sync.Mutex
+	m  map[string]*groupLock
+}
+
+/*
+The group locks of a database.
+
+A lock only stays in the map, while it is held or while it caches the
+statistics of a group. So locks of unknown or removed groups don't accumulate.
+The map is sharded, so writers to different groups rarely contend.
+*/
+type groupLocks struct {
+	shards [lock_shards]lockShard
+}
+
+func (g *groupLocks) shard(grp []byte) *lockShard {
+	h := uint32(2166136261)
+	for _,b := range grp { h = (h^uint32(b))*16777619 }
+	return &g.shards[h%lock_shards]
+}
+
+// Returns the lock of grp and increments its reference count.
+func (g *groupLocks) acquire(grp []byte) *groupLock {
+	sh := g.shard(grp)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	gl := sh.m[string(grp)]
+	if gl==nil {
+		if sh.m==nil { sh.m = make(map[string]*groupLock) }
+		gl = new(groupLock)
+		sh.m[string(grp)] = gl
+	}
+	gl.refs++
+	return gl
+}
+
+// Decrements the reference count of the lock. Unused locks without cached statistics are dropped.
+func (g *groupLocks) release(grp []byte, gl *groupLock) {
+	sh := g.shard(grp)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	gl.refs--
+	if gl.refs==0 && atomic.LoadInt32(&gl.loaded)==0 { delete(sh.m,string(grp)) }
+}
+
+// Returns the lock of grp. The caller must hold a reference.
+func (g *groupLocks) get(grp []byte) *groupLock {
+	sh := g.shard(grp)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.m[string(grp)]
+}
+
+/*
+Sorts the groups and removes duplicates. Locks are always acquired in this
+order, to prevent deadlocks.
+*/
+func lockOrder(grps [][]byte) [][]byte {
+	s := make([][]byte,len(grps))
+	copy(s,grps)
+	sort.Slice(s,func(i, j int) bool { return bytes.Compare(s[i],s[j])<0 })
+	j := 0
+	for i,grp := range s {
+		if i>0 && bytes.Equal(s[j-1],grp) { continue }
+		s[j] = grp
+		j++
+	}
+	return s[:j]
+}
+
+/*
+Locks a group exclusively.
+*/
+func (ov *OvLDB) lock_group(grp []byte) func() {
+	gl := ov.locks.acquire(grp)
+	gl.Lock()
+	gl.flush(ov,grp)
+	return func() {
+		gl.Unlock()
+		ov.locks.release(grp,gl)
+	}
+}
+
+/*
+Locks multiple groups exclusively.
+*/
+func (ov *OvLDB) lock_groups(grps ...[]byte) func() {
+	grps = lockOrder(grps)
+	gls := make([]*groupLock,len(grps))
+	for i,grp := range grps {
+		gls[i] = ov.locks.acquire(grp)
+		gls[i].Lock()
+		gls[i].flush(ov,grp)
+	}
+	return func() {
+		for i := len(gls)-1; i>=0; i-- {
+			gls[i].Unlock()
+			ov.locks.release(grps[i],gls[i])
+		}
+	}
+}
+
+/*
+Takes the read lock of multiple groups.
+*/
+func (ov *OvLDB) rlock_groups(grps ...[]byte) func() {
+	grps = lockOrder(grps)
+	gls := make([]*groupLock,len(grps))
+	for i,grp := range grps {
+		gls[i] = ov.locks.acquire(grp)
+		gls[i].RLock()
+	}
+	return func() {
+		for i := len(gls)-1; i>=0; i-- {
+			gls[i].RUnlock()
+			ov.locks.release(grps[i],gls[i])
+		}
+	}
+}
+
+/*
+Adds an Overview line to bat and assigns its number, using the cached group
+statistics. The caller must hold the read lock of the group. The stats-record is
+added by writeOv().
+*/
+func (ov *OvLDB) addOv(bat *leveldb.Batch, grp []byte, autonum bool, tk *storage.TOKEN, ove *storage.OverviewElement, buf []byte) (gl *groupLock, err error) {
+	kf,vf := ov.formats(grp)
+	gl = ov.locks.get(grp)
+	if err = gl.load(ov,kf,vf,grp); err!=nil { return }
+	if autonum {
+		ove.Num = atomic.AddInt64(&gl.high,1)
+	} else {
+		gl.raise(ove.Num)
+	}
+	bat.Put(kf.recid(grp,ove.Num),vf.joinRecord(buf,tk,ove))
+	return
+}
+
+/*
+Adds the stats-records of the groups to bat and writes it. gls are the locks
+returned by addOv(), one per Overview line. The caller must hold the read locks
+of the groups.
+*/
+func (ov *OvLDB) writeOv(bat *leveldb.Batch, grps [][]byte, gls []*groupLock) (err error) {
+	grps = lockOrder(grps)
+	wls := make([]*groupLock,len(grps))
+	for i,grp := range grps {
+		wls[i] = ov.locks.get(grp)
+		wls[i].wmu.Lock()
+	}
+	defer func() {
+		for i := len(wls)-1; i>=0; i-- { wls[i].wmu.Unlock() }
+	}()
+	
+	for _,gl := range gls { atomic.AddInt64(&gl.num,1) }
+	for i,grp := range grps {
+		kf,vf := ov.formats(grp)
+		bat.Put(kf.gstatid(grp),wls[i].gstat(vf))
+	}
+	err = ov.DB.Write(bat,nil)
+	if err!=nil {
+		for _,gl := range gls { atomic.AddInt64(&gl.num,-1) }
+	}
+	return
+}
@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package ovldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Checks the stats-record of grp against its Overview lines.
+func checkGroupStat(t *testing.T, ov *OvLDB, grp []byte) {
+	num,_,high,err := ov.GroupStat(grp)
+	if err!=nil { t.Fatal(err) }
+	var n,last int64
+	ove := new(storage.OverviewElement)
+	cur,err := ov.FetchAll(grp,0,math.MaxInt64,new(storage.TOKEN),ove)
+	if err!=nil { t.Fatal(err) }
+	for cur.Next() {
+		n++
+		last = ove.Num
+	}
+	cur.Release()
+	if num!=n || high<last { t.Errorf("%s: GroupStat num=%d high=%d, but %d lines up to %d",grp,num,high,n,last) }
+}
+
+/*
+Two writers holding the read lock commit their batches in reverse order.
+*/
+func TestGroupWriteOvOrder(t *testing.T) {
+	dir,err := ioutil.TempDir("","ovldb-test")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	ov,err := OpenSpoolOvLDB(dir,nil)
+	if err!=nil { t.Fatal(err) }
+	defer ov.DB.Close()
+	
+	grp := []byte("test.a")
+	if err = ov.InitGroup(grp); err!=nil { t.Fatal(err) }
+	
+	unlock := ov.rlock_groups(grp)
+	tk := new(storage.TOKEN)
+	bat1,bat2 := new(leveldb.Batch),new(leveldb.Batch)
+	gl1,err := ov.addOv(bat1,grp,true,tk,&storage.OverviewElement{MsgId: []byte("<1@example.org>")},nil)
+	if err!=nil { t.Fatal(err) }
+	gl2,err := ov.addOv(bat2,grp,true,tk,&storage.OverviewElement{MsgId: []byte("<2@example.org>")},nil)
+	if err!=nil { t.Fatal(err) }
+	if err = ov.writeOv(bat2,[][]byte{grp},[]*groupLock{gl2}); err!=nil { t.Fatal(err) }
+	if err = ov.writeOv(bat1,[][]byte{grp},[]*groupLock{gl1}); err!=nil { t.Fatal(err) }
+	unlock()
+	
+	checkGroupStat(t,ov,grp)
+	if num,_,high,_ := ov.GroupStat(grp); num!=2 || high!=2 { t.Errorf("num=%d high=%d",num,high) }
+}
+
+func TestConcurrentGroupWriteOv(t *testing.T) {
+	dir,err := ioutil.TempDir("","ovldb-test")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	ov,err := OpenSpoolOvLDB(dir,nil)
+	if err!=nil { t.Fatal(err) }
+	
+	grps := [][]byte{[]byte("test.a"),[]byte("test.b"),[]byte("test.c")}
+	for _,grp := range grps {
+		if err = ov.InitGroup(grp); err!=nil { t.Fatal(err) }
+	}
+	md := &storage.Article_MD{Arrival: time.Now(), Expires: time.Now().Add(time.Hour)}
+	
+	var wg sync.WaitGroup
+	for w := 0; w<16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			tk := new(storage.TOKEN)
+			ove := &storage.OverviewElement{MsgId: []byte(fmt.Sprintf("<%d@example.org>",w))}
+			for i := 0; i<100; i++ {
+				var err error
+				if i%2==0 {
+					err = ov.GroupWriteOv(grps[(w+i)%len(grps)],true,md,tk,ove)
+				} else {
+					err = ov.GroupWriteOvBatch(grps,true,md,tk,ove,make([]int64,len(grps)))
+				}
+				if err!=nil { t.Error(err); return }
+			}
+		}(w)
+	}
+	wg.Wait()
+	
+	for _,grp := range grps { checkGroupStat(t,ov,grp) }
+	
+	/* The stored records must be correct as well. */
+	ov.DB.Close()
+	ov,err = OpenSpoolOvLDB(dir,nil)
+	if err!=nil { t.Fatal(err) }
+	defer ov.DB.Close()
+	for _,grp := range grps { checkGroupStat(t,ov,grp) }
+}
+
+func benchGroupWriteOv(b *testing.B, ngroups int) {
+	dir,err := ioutil.TempDir("","ovldb-bench")
+	if err!=nil { b.Fatal(err) }
+	defer os.RemoveAll(dir)
+	ov,err := OpenSpoolOvLDB(dir,nil)
+	if err!=nil { b.Fatal(err) }
+	defer ov.DB.Close()
+	
+	grps := make([][]byte,ngroups)
+	for i := range grps {
+		grps[i] = []byte(fmt.Sprintf("bench.group.%d",i))
+		if err = ov.InitGroup(grps[i]); err!=nil { b.Fatal(err) }
+	}
+	md := &storage.Article_MD{Arrival: time.Now(), Expires: time.Now().Add(time.Hour)}
+	
+	var worker int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		grp := grps[int(atomic.AddInt32(&worker,1))%len(grps)]
+		tk := new(storage.TOKEN)
+		ove := &storage.OverviewElement{Subject: []byte("Subject"), From: []byte("from@example.org"), MsgId: []byte("<bench@example.org>")}
+		for pb.Next() {
+			if err := ov.GroupWriteOv(grp,true,md,tk,ove); err!=nil { b.Error(err); return }
+		}
+	})
+}
+
+/*
+Compares concurrent writers to a single group with concurrent writers, that
+each write to an own group.
+*/
+func BenchmarkGroupWriteOv(b *testing.B) {
+	b.Run("OneGroup",func(b *testing.B) { benchGroupWriteOv(b,1) })
+	b.Run("ManyGroups",func(b *testing.B) { benchGroupWriteOv(b,64) })
+}
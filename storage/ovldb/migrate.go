@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ovldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"context"
+	"sync/atomic"
+)
+
+const migrate_batch = 1<<10
+
+/*
+Extracts the group name from a V1 key. Returns nil if the key is not a V1 key.
+*/
+func v1group(key []byte) []byte {
+	l := len(key)
+	if l>9 && key[l-9]==0 { return key[:l-9] }
+	if l>1 && key[l-1]==0xff { return key[:l-1] }
+	return nil
+}
+
+/*
+Rewrites a V1 database into the V2 format.
+
+The migration is performed group by group, while the database keeps serving
+reads and writes. It can be cancelled using ctx and resumed by calling MigrateV2
+again, even after a restart.
+*/
+func (ov *OvLDB) MigrateV2(ctx context.Context) (err error) {
+	ov.migmu.Lock()
+	defer ov.migmu.Unlock()
+	
+	if ov.Version()==Version_2 { return }
+	
+	err = ov.DB.Put(k_version,[]byte{Version_Migrating},nil)
+	if err!=nil { return }
+	atomic.StoreInt32(&ov.migrating,1)
+	
+	/* Repeat, until a whole pass doesn't find any V1 group. */
+	for {
+		var n int
+		n,err = ov.migratePass(ctx)
+		if err!=nil { return }
+		if n==0 { break }
+	}
+	
+	err = ov.DB.Put(k_version,[]byte{Version_2},nil)
+	if err!=nil { return }
+	ov.OvKeyFormat = ov.v2
+	ov.OvValFormat = ov.v2
+	atomic.StoreInt32(&ov.migrating,0)
+	return
+}
+
+func (ov *OvLDB) migratePass(ctx context.Context) (n int, err error) {
+	/* V1 keys start with the group name, which is printable. */
+	start := []byte{0x20}
+	for {
+		if err = ctx.Err(); err!=nil { return }
+		
+		var key []byte
+		iter := ov.DB.NewIterator(&util.Range{Start: start},nil)
+		if iter.First() { key = append(key,iter.Key()...) }
+		iter.Release()
+		if key==nil { return }
+		
+		grp := v1group(key)
+		if grp==nil { start = append(key,0); continue } /* Not a V1 key. Skip it. */
+		
+		err = ov.migrateGroup(ctx,grp)
+		if err!=nil { return }
+		n++
+		start = grp
+	}
+}
+
+/*
+Migrates one group. The records are copied first, then the group-id is
+published, and finally the V1 keys are removed.
+
+If the migration is interrupted before the group-id is published, the copied
+records are left behind under an unused group-id.
+*/
+func (ov *OvLDB) migrateGroup(ctx context.Context, grp []byte) (err error) {
+	defer ov.lock_group(grp)()
+	kf,vf := i_ovkf1,i_ovvf1
+	tk := new(storage.TOKEN)
+	ove := new(storage.OverviewElement)
+	
+	lim := append(append(make([]byte,0,len(grp)+1),grp...),0x01)
+	rng := &util.Range{Start: kf.recid(grp,0), Limit: lim}
+	
+	if ov.v2.gid(grp)==0 {
+		var id uint32
+		id,err = ov.v2.alloc()
+		if err!=nil { return }
+		
+		var num,low,high int64
+		rec,err1 := ov.DB.Get(kf.gstatid(grp),nil)
+		if err1==nil { num,low,high,err1 = vf.explodeGstat(rec) }
+		
+		/* The stats-record is missing or corrupt: recount. */
+		recount := err1!=nil
+		if recount { num,low,high = 0,1,0 }
+		
+		bat := new(leveldb.Batch)
+		buf := make([]byte,0,1<<10)
+		iter := ov.DB.NewIterator(rng,nil)
+		for iter.Next() {
+			ove.Num = kf.recid2num(iter.Key())
+			if vf.explodeRecord(iter.Value(),tk,ove)!=nil { continue } /* Corrupt record. Drop it. */
+			if recount {
+				if num==0 || ove.Num<low { low = ove.Num }
+				if ove.Num>high { high = ove.Num }
+				num++
+			}
+			bat.Put(recid2(id,ove.Num),ov.v2.joinRecord(buf,tk,ove))
+			if bat.Len()>=migrate_batch {
+				if err = ctx.Err(); err==nil { err = ov.DB.Write(bat,nil) }
+				if err!=nil { iter.Release(); return }
+				bat.Reset()
+			}
+		}
+		iter.Release()
+		
+		ov.v2.assign(bat,grp,id)
+		bat.Put(gstatid2(id),ov.v2.joinGstat(nil,num,low,high))
+		err = ov.DB.Write(bat,nil)
+		if err!=nil { return }
+		ov.v2.published(grp,id)
+	}
+	
+	/* The group is available in the V2 format. Remove the V1 keys. */
+	bat := new(leveldb.Batch)
+	iter := ov.DB.NewIterator(rng,nil)
+	for iter.Next() {
+		bat.Delete(iter.Key())
+		if bat.Len()>=migrate_batch {
+			err = ov.DB.Write(bat,nil)
+			if err!=nil { iter.Release(); return }
+			bat.Reset()
+		}
+	}
+	iter.Release()
+	bat.Delete(kf.gstatid(grp))
+	return ov.DB.Write(bat,nil)
+}
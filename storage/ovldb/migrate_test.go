@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package ovldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+A context, that is cancelled after Err() has been called n times.
+*/
+type countdownCtx struct {
+	context.Context
+	n int32
+}
+
+func (c *countdownCtx) Err() error {
+	if atomic.AddInt32(&c.n,-1)<0 { return context.Canceled }
+	return nil
+}
+
+const (
+	mig_groups   = 5
+	mig_articles = 1500 // More than migrate_batch.
+)
+
+func migGroup(i int) []byte { return []byte(fmt.Sprintf("test.group.%d",i)) }
+
+// Checks the groups against the articles written by TestMigrateV2.
+func checkMigrated(t *testing.T, ov *OvLDB) {
+	tk := new(storage.TOKEN)
+	ove := new(storage.OverviewElement)
+	for i := 0; i<mig_groups; i++ {
+		grp := migGroup(i)
+		num,low,high,err := ov.GroupStat(grp)
+		if err!=nil { t.Fatalf("%s: %v",grp,err) }
+		if num!=mig_articles || low!=1 || high!=mig_articles { t.Errorf("%s: num=%d low=%d high=%d",grp,num,low,high) }
+		
+		cur,err := ov.FetchAll(grp,0,math.MaxInt64,tk,ove)
+		if err!=nil { t.Fatalf("%s: %v",grp,err) }
+		var n int64
+		for cur.Next() {
+			n++
+			if ove.Num!=n || string(ove.MsgId)!=fmt.Sprintf("<%d.%d@example.org>",i,n) {
+				t.Errorf("%s: got %d %s at %d",grp,ove.Num,ove.MsgId,n)
+				break
+			}
+		}
+		cur.Release()
+		if n!=mig_articles { t.Errorf("%s: %d records",grp,n) }
+	}
+}
+
+func TestMigrateV2(t *testing.T) {
+	dir,err := ioutil.TempDir("","ovldb-test")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	
+	/* Create a V1 database. */
+	db,err := leveldb.OpenFile(filepath.Join(dir,"ovldb"),nil)
+	if err!=nil { t.Fatal(err) }
+	if err = db.Put(k_version,[]byte{Version_1},nil); err!=nil { t.Fatal(err) }
+	db.Close()
+	
+	ov,err := OpenSpoolOvLDB(dir,nil)
+	if err!=nil { t.Fatal(err) }
+	if ov.Version()!=Version_1 { t.Fatalf("version %d",ov.Version()) }
+	md := &storage.Article_MD{Arrival: time.Now(), Expires: time.Now().Add(time.Hour)}
+	tk := new(storage.TOKEN)
+	for i := 0; i<mig_groups; i++ {
+		grp := migGroup(i)
+		if err = ov.InitGroup(grp); err!=nil { t.Fatal(err) }
+		for j := 1; j<=mig_articles; j++ {
+			ove := &storage.OverviewElement{Subject: []byte("Subject"), MsgId: []byte(fmt.Sprintf("<%d.%d@example.org>",i,j))}
+			if err = ov.GroupWriteOv(grp,true,md,tk,ove); err!=nil { t.Fatal(err) }
+		}
+	}
+	checkMigrated(t,ov)
+	
+	/* Interrupt the migration in the middle. */
+	err = ov.MigrateV2(&countdownCtx{Context: context.Background(), n: 4})
+	if err!=context.Canceled { t.Fatalf("MigrateV2: %v",err) }
+	checkMigrated(t,ov)
+	ov.DB.Close()
+	
+	/* Resume it after a restart. */
+	ov,err = OpenSpoolOvLDB(dir,nil)
+	if err!=nil { t.Fatal(err) }
+	defer ov.DB.Close()
+	if ov.Version()!=Version_Migrating { t.Fatalf("version %d",ov.Version()) }
+	checkMigrated(t,ov)
+	if err = ov.MigrateV2(context.Background()); err!=nil { t.Fatal(err) }
+	if ov.Version()!=Version_2 { t.Fatalf("version %d",ov.Version()) }
+	checkMigrated(t,ov)
+	
+	/* V1 keys start with the group name; V2 keys with a prefix below 0x20. */
+	iter := ov.DB.NewIterator(&util.Range{Start: []byte{0x20}},nil)
+	if iter.First() { t.Errorf("V1 key left: %q",iter.Key()) }
+	iter.Release()
+}
@@ -32,8 +32,8 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	
 	"github.com/byte-mug/fastnntp-backend2/storage"
-	"github.com/byte-mug/fastnntp-backend2/utils/minihash"
 	"sync"
+	"sync/atomic"
 	"encoding/binary"
 	"io"
 	"errors"
@@ -47,12 +47,10 @@ func debugf(f string, i ...interface{}) { fmt.Printf(f+"\n",i...) }
 
 var eRecShort = io.ErrUnexpectedEOF
 var eNoEnt = errors.New("No Entry")
+var eGroupExists = errors.New("Group exists")
+var eBadBatch = errors.New("Batch: len(nums)!=len(grps)")
 var bin = binary.BigEndian
 
-const m_locks_size = 1<<12
-const m_locks_mask = m_locks_size-1
-var m_locks [m_locks_size]sync.Mutex
-
 func tsplit(p []byte) ([]byte,[]byte) {
 	for i,b := range p {
 		if b=='\t' { return p[:i],p[i+1:] }
@@ -69,6 +67,7 @@ type OvKeyFormat interface {
 	recid(grp []byte, num int64) []byte
 	recid_incr(rid []byte)
 	recid2num(recid []byte) int64
+	initgroup(grp []byte) error
 }
 
 type OvValFormat interface {
@@ -82,8 +81,26 @@ type OvLDB struct {
 	OvKeyFormat
 	OvValFormat
 	DB *leveldb.DB
+	
+	v2        *ovf2
+	migrating int32
+	migmu     sync.Mutex
+	locks     groupLocks
 }
 
+/*
+Format versions, as recorded in the database.
+*/
+const (
+	Version_1 = 1
+	Version_2 = 2
+	
+	// The database is being migrated from V1 to V2.
+	Version_Migrating = 0x12
+)
+
+var k_version = []byte{p2_meta,'v','e','r'}
+
 var _ storage.OverviewMethod = (*OvLDB)(nil)
 
 type ovf1 int
@@ -128,6 +145,7 @@ func (ovf1) recid2num(recid []byte) int64 {
 	if len(recid)<8 { return 0 }
 	return int64(bin.Uint64(recid[len(recid)-8:]))
 }
+func (ovf1) initgroup(grp []byte) error { return nil }
 
 
 func (ovf1) explodeRecord(rec []byte, tk *storage.TOKEN, ove *storage.OverviewElement) (err error) {
@@ -180,19 +198,28 @@ func (ovf1) joinGstat(buf []byte, num, low, high int64) (rec []byte) {
 	return rec
 }
 
-func (ov *OvLDB) lock_group(grp []byte) func() {
-	l := &m_locks[minihash.HashBytes(grp)&m_locks_mask]
-	l.Lock()
-	return l.Unlock
+/*
+Returns the key and value format for the group grp.
+
+While the database is migrated from V1 to V2, each group uses the V2 format
+as soon as it has been migrated and the V1 format before that.
+*/
+func (ov *OvLDB) formats(grp []byte) (OvKeyFormat,OvValFormat) {
+	if atomic.LoadInt32(&ov.migrating)!=0 {
+		if ov.v2.gid(grp)!=0 { return ov.v2,ov.v2 }
+		return i_ovkf1,i_ovvf1
+	}
+	return ov.OvKeyFormat,ov.OvValFormat
 }
 
 
 func (ov *OvLDB) FetchOne(grp []byte, num int64, tk *storage.TOKEN, ove *storage.OverviewElement) (rel storage.Releaser,err error) {
 	var rid,rec []byte
-	rid = ov.recid(grp,num)
+	kf,vf := ov.formats(grp)
+	rid = kf.recid(grp,num)
 	rec,err = ov.DB.Get(rid,nil)
 	ove.Num = num
-	if err==nil { err = ov.explodeRecord(rec,tk,ove) }
+	if err==nil { err = vf.explodeRecord(rec,tk,ove) }
 	return
 }
 
@@ -200,7 +227,8 @@ type cursor struct{
 	iterator.Iterator
 	tk *storage.TOKEN
 	ove *storage.OverviewElement
-	ov *OvLDB
+	kf OvKeyFormat
+	vf OvValFormat
 	next bool
 }
 func (c *cursor) Next() (ok bool) {
@@ -214,8 +242,8 @@ restart:
 	if !ok { return }
 	
 	//debugf("ITER %q %q",c.Key(),c.Value())
-	c.ove.Num = c.ov.recid2num(c.Key())
-	err := c.ov.explodeRecord(c.Value(),c.tk,c.ove)
+	c.ove.Num = c.kf.recid2num(c.Key())
+	err := c.vf.explodeRecord(c.Value(),c.tk,c.ove)
 	if err!=nil { goto restart }
 	
 	return
@@ -223,16 +251,18 @@ restart:
 
 func (ov *OvLDB) FetchAll(grp []byte, num, lastnum int64, tk *storage.TOKEN, ove *storage.OverviewElement) (cur storage.Cursor,err error) {
 	var rid,lid []byte
-	rid = ov.recid(grp,num)
-	lid = ov.recid(grp,lastnum)
-	ov.recid_incr(lid)
+	kf,vf := ov.formats(grp)
+	rid = kf.recid(grp,num)
+	lid = kf.recid(grp,lastnum)
+	kf.recid_incr(lid)
 	iter := ov.DB.NewIterator(&util.Range{rid,lid},nil)
-	cur = &cursor{iter,tk,ove,ov,false}
+	cur = &cursor{iter,tk,ove,kf,vf,false}
 	return
 }
 func (ov *OvLDB) SeekOne(grp []byte, num int64, back bool, tk *storage.TOKEN, ove *storage.OverviewElement) (rel storage.Releaser,err error) {
 	var rid,rec []byte
-	rid = ov.recid(grp,num)
+	kf,vf := ov.formats(grp)
+	rid = kf.recid(grp,num)
 	
 	iter := ov.DB.NewIterator(nil,nil)
 	ok := iter.Seek(rid)
@@ -246,13 +276,13 @@ func (ov *OvLDB) SeekOne(grp []byte, num int64, back bool, tk *storage.TOKEN, ov
 	}
 	
 	/* Check, that we did't went into the next newsgroup group accidentially. */
-	if ok { ok = ov.recid_prefix_eq(rid,iter.Key()) }
+	if ok { ok = kf.recid_prefix_eq(rid,iter.Key()) }
 	
 	if !ok { iter.Release(); err = eNoEnt; return }
 	rec = iter.Value()
 	
-	ove.Num = ov.recid2num(iter.Key())
-	if err==nil { err = ov.explodeRecord(rec,tk,ove) }
+	ove.Num = kf.recid2num(iter.Key())
+	if err==nil { err = vf.explodeRecord(rec,tk,ove) }
 	
 	if err!=nil { iter.Release(); return }
 	
@@ -262,83 +292,83 @@ func (ov *OvLDB) SeekOne(grp []byte, num int64, back bool, tk *storage.TOKEN, ov
 }
 func (ov *OvLDB) GroupStat(grp []byte) (num, low, high int64, err error) {
 	var rec []byte
-	rec,err = ov.DB.Get(ov.gstatid(grp),nil)
+	kf,vf := ov.formats(grp)
+	rec,err = ov.DB.Get(kf.gstatid(grp),nil)
 	if err!=nil { return }
-	return ov.explodeGstat(rec)
+	return vf.explodeGstat(rec)
 }
 
 func (ov *OvLDB) GroupWriteOv(grp []byte, autonum bool, md *storage.Article_MD, tk *storage.TOKEN, ove *storage.OverviewElement) (err error) {
-	defer ov.lock_group(grp)()
-	var mrid,mrec,rid,rec []byte
-	var num int64
+	defer ov.rlock_groups(grp)()
 	
-	mrid = ov.gstatid(grp)
-	{
-		omrec,err1 := ov.DB.Get(mrid,nil)
-		if err1!=nil { return err1 }
-		anum,low,high,err1 := ov.explodeGstat(omrec)
-		if err1!=nil { return err1 }
-		anum++
-		if autonum {
-			high++
-			num = high
-			ove.Num = num
-		} else {
-			num = ove.Num
-			if high<num { high = num}
-		}
-		mrec = ov.joinGstat(make([]byte,32),anum,low,high)
-	}
+	bat := leveldb.MakeBatch(1<<10)
+	gl,err := ov.addOv(bat,grp,autonum,tk,ove,make([]byte,0,1<<10))
+	if err!=nil { return }
 	
-	rid = ov.recid(grp,num)
-	ove.Num = num
-	rec = ov.joinRecord(make([]byte,0,1<<10),tk,ove)
+	err = ov.writeOv(bat,[][]byte{grp},[]*groupLock{gl})
+	if err!=nil { gl.unadd(autonum,ove.Num) }
+	return
+}
+func (ov *OvLDB) GroupWriteOvBatch(grps [][]byte, autonum bool, md *storage.Article_MD, tk *storage.TOKEN, ove *storage.OverviewElement, nums []int64) (err error) {
+	if len(nums)!=len(grps) { return eBadBatch }
+	defer ov.rlock_groups(grps...)()
 	
+	gls := make([]*groupLock,0,len(grps))
+	defer func() {
+		if err==nil { return }
+		for i := len(gls)-1; i>=0; i-- { gls[i].unadd(autonum,nums[i]) }
+	}()
 	
+	buf := make([]byte,0,1<<10)
 	bat := leveldb.MakeBatch(1<<10)
-	bat.Put(rid,rec)
-	bat.Put(mrid,mrec)
+	for i,grp := range grps {
+		var gl *groupLock
+		if !autonum { ove.Num = nums[i] }
+		gl,err = ov.addOv(bat,grp,autonum,tk,ove,buf)
+		if err!=nil { return }
+		gls = append(gls,gl)
+		nums[i] = ove.Num
+	}
 	
-	err = ov.DB.Write(bat,nil)
+	err = ov.writeOv(bat,grps,gls)
+	return
+}
+func (ov *OvLDB) GroupReserveNums(grps [][]byte, nums []int64) (err error) {
+	if len(nums)!=len(grps) { return eBadBatch }
+	defer ov.rlock_groups(grps...)()
+	
+	for i,grp := range grps {
+		kf,vf := ov.formats(grp)
+		gl := ov.locks.get(grp)
+		if err = gl.load(ov,kf,vf,grp); err!=nil { return }
+		nums[i] = atomic.AddInt64(&gl.high,1)
+	}
 	return
 }
 func (ov *OvLDB) CancelOv(grp []byte, num int64) (err error) {
 	defer ov.lock_group(grp)()
 	var mrid,mrec,rid []byte
+	kf,vf := ov.formats(grp)
 	
-	mrid = ov.gstatid(grp)
+	/* Don't touch the stats-record, if there is nothing to delete. */
+	rid = kf.recid(grp,num)
+	if _,err = ov.DB.Get(rid,nil); err!=nil { return }
+	
+	mrid = kf.gstatid(grp)
 	{
 		omrec,err1 := ov.DB.Get(mrid,nil)
 		if err1!=nil { return err1 }
-		anum,low,high,err1 := ov.explodeGstat(omrec)
+		anum,low,high,err1 := vf.explodeGstat(omrec)
 		if err1!=nil { return err1 }
 		anum--
 		
+		if low < num { low = ov.firstFrom(kf,grp,low,high+1) }
+		if low == num { low = ov.firstFrom(kf,grp,num+1,high+1) }
 		
-		iter := ov.DB.NewIterator(nil,nil)
-		if low < num {
-			rid = ov.recid(grp,low)
-			if !iter.Seek(rid) {
-				low = high
-			} else {
-				low = ov.recid2num(iter.Key())
-			}
-		}
-		if low == num {
-			rid = ov.recid(grp,num+1)
-			if !iter.Seek(rid) {
-				low = high
-			} else {
-				low = ov.recid2num(iter.Key())
-			}
-		}
-		iter.Release()
-		
-		mrec = ov.joinGstat(make([]byte,32),anum,low,high)
+		mrec = vf.joinGstat(make([]byte,32),anum,low,high)
 	}
 	
 	bat := leveldb.MakeBatch(1<<10)
-	rid = ov.recid(grp,num)
 	bat.Delete(rid)
 	bat.Put(mrid,mrec)
 	
@@ -346,40 +376,93 @@ func (ov *OvLDB) CancelOv(grp []byte, num int64) (err error) {
 	return
 }
 
-
 func (ov *OvLDB) InitGroup(grp []byte) (err error) {
 	defer ov.lock_group(grp)()
-	rid := ov.gstatid(grp)
-	rec,err1 := ov.DB.Get(ov.gstatid(grp),nil)
-	num,low,high,err2 := ov.explodeGstat(rec)
+	kf,vf := ov.formats(grp)
+	
+	/*
+	New groups, that are created during the migration, are created in the
+	V2 format right away.
+	*/
+	if atomic.LoadInt32(&ov.migrating)!=0 && kf==i_ovkf1 {
+		if _,err1 := ov.DB.Get(kf.gstatid(grp),nil); err1==leveldb.ErrNotFound {
+			kf,vf = ov.v2,ov.v2
+		}
+	}
+	
+	err = kf.initgroup(grp)
+	if err!=nil { return }
+	rid := kf.gstatid(grp)
+	rec,err1 := ov.DB.Get(rid,nil)
+	num,low,high,err2 := vf.explodeGstat(rec)
 	
 	if err1!=nil || err2!=nil {
 		num,low,high = 0,1,0
 	}
-	rec = ov.joinGstat(make([]byte,32),num,low,high)
+	rec = vf.joinGstat(make([]byte,32),num,low,high)
 	
 	return ov.DB.Put(rid,rec,nil)
 }
 
+/*
+Returns the format version of the database.
+*/
+func (ov *OvLDB) Version() int {
+	if atomic.LoadInt32(&ov.migrating)!=0 { return Version_Migrating }
+	if ov.OvKeyFormat==OvKeyFormat(ov.v2) { return Version_2 }
+	return Version_1
+}
 
-func OpenOvLDB(path string) (*OvLDB,error) {
-	db,err := leveldb.OpenFile(path, nil)
-	if err!=nil { return nil,err }
-	return &OvLDB{
+func newOvLDB(db *leveldb.DB) (*OvLDB,error) {
+	ov := &OvLDB{
 		OvKeyFormat: i_ovkf1,
 		OvValFormat: i_ovvf1,
 		DB: db,
-	},nil
+		v2: newOvf2(db),
+	}
+	ver,err := db.Get(k_version,nil)
+	if err==leveldb.ErrNotFound {
+		/* Databases without version marker are V1, unless they are empty. */
+		iter := db.NewIterator(nil,nil)
+		empty := !iter.First()
+		iter.Release()
+		ver = []byte{Version_1}
+		if empty { ver = []byte{Version_2} }
+		err = db.Put(k_version,ver,nil)
+	}
+	if err!=nil { return nil,err }
+	if len(ver)!=1 { return nil,fmt.Errorf("ovldb: bad version marker %x",ver) }
+	
+	switch ver[0] {
+	case Version_1:
+	case Version_2:
+		ov.OvKeyFormat = ov.v2
+		ov.OvValFormat = ov.v2
+	case Version_Migrating:
+		/* The caller is expected to resume the migration using MigrateV2(). */
+		ov.OvKeyFormat = ov.v2
+		ov.OvValFormat = ov.v2
+		ov.migrating = 1
+	default:
+		return nil,fmt.Errorf("ovldb: unsupported version %d",ver[0])
+	}
+	return ov,nil
+}
+
+func OpenOvLDB(path string) (*OvLDB,error) {
+	db,err := leveldb.OpenFile(path, nil)
+	if err!=nil { return nil,err }
+	ov,err := newOvLDB(db)
+	if err!=nil { db.Close(); return nil,err }
+	return ov,nil
 }
 
 func OpenSpoolOvLDB(spool string, o *opt.Options) (*OvLDB,error) {
 	db,err := leveldb.OpenFile(filepath.Join(spool,"ovldb"), o)
 	if err!=nil { return nil,err }
-	return &OvLDB{
-		OvKeyFormat: i_ovkf1,
-		OvValFormat: i_ovvf1,
-		DB: db,
-	},nil
+	ov,err := newOvLDB(db)
+	if err!=nil { db.Close(); return nil,err }
+	return ov,nil
 }
 
 
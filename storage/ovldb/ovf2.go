@@ -0,0 +1,226 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ovldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"encoding/binary"
+	"sync"
+)
+
+/*
+Key prefixes of the V2 format.
+
+V1 keys start with the group name, which is printable. V2 keys start with a
+control character, so both formats can coexist in one database while it is
+being migrated.
+*/
+const (
+	p2_meta  = 0x00
+	p2_gid   = 0x01 // 0x01 <group> -> gid
+	p2_gstat = 0x02 // 0x02 <gid>
+	p2_rec   = 0x03 // 0x03 <gid> <num>
+)
+
+var k2_gidcounter = []byte{p2_meta,'g','i','d'}
+
+/*
+The V2 format. Instead of repeating the group name in every key, each group is
+assigned a 32-bit group-id. Numbers in the records are varint-encoded.
+
+Group-ids start at 1. The group-id 0 is never assigned, so lookups of unknown
+groups simply fail with leveldb.ErrNotFound.
+*/
+type ovf2 struct {
+	db   *leveldb.DB
+	mu   sync.RWMutex
+	gids map[string]uint32
+	next uint32
+}
+
+func newOvf2(db *leveldb.DB) *ovf2 {
+	return &ovf2{db:db,gids:make(map[string]uint32)}
+}
+
+func gidkey(grp []byte) []byte {
+	k := make([]byte,len(grp)+1)
+	k[0] = p2_gid
+	copy(k[1:],grp)
+	return k
+}
+
+/*
+Returns the group-id of grp or 0, if the group is unknown.
+*/
+func (f *ovf2) gid(grp []byte) uint32 {
+	f.mu.RLock()
+	id := f.gids[string(grp)]
+	f.mu.RUnlock()
+	if id!=0 { return id }
+	
+	rec,err := f.db.Get(gidkey(grp),nil)
+	if err!=nil || len(rec)<4 { return 0 }
+	id = bin.Uint32(rec)
+	
+	f.mu.Lock()
+	f.gids[string(grp)] = id
+	f.mu.Unlock()
+	return id
+}
+
+/*
+Allocates a new group-id. The group-id is not yet assigned to any group.
+*/
+func (f *ovf2) alloc() (id uint32, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.next==0 {
+		rec,err1 := f.db.Get(k2_gidcounter,nil)
+		if err1==nil && len(rec)>=4 { f.next = bin.Uint32(rec) }
+		if f.next==0 { f.next = 1 }
+	}
+	id = f.next
+	var b4 [4]byte
+	bin.PutUint32(b4[:],id+1)
+	err = f.db.Put(k2_gidcounter,b4[:],nil)
+	if err!=nil { return 0,err }
+	f.next++
+	return
+}
+
+/*
+Assigns the group-id to grp. The assignment is written into bat and becomes
+visible once the caller calls published().
+*/
+func (f *ovf2) assign(bat *leveldb.Batch, grp []byte, id uint32) {
+	var b4 [4]byte
+	bin.PutUint32(b4[:],id)
+	bat.Put(gidkey(grp),b4[:])
+}
+func (f *ovf2) published(grp []byte, id uint32) {
+	f.mu.Lock()
+	f.gids[string(grp)] = id
+	f.mu.Unlock()
+}
+func (f *ovf2) forget(grp []byte) {
+	f.mu.Lock()
+	delete(f.gids,string(grp))
+	f.mu.Unlock()
+}
+
+func (f *ovf2) initgroup(grp []byte) (err error) {
+	if f.gid(grp)!=0 { return }
+	id,err := f.alloc()
+	if err!=nil { return }
+	bat := new(leveldb.Batch)
+	f.assign(bat,grp,id)
+	err = f.db.Write(bat,nil)
+	if err==nil { f.published(grp,id) }
+	return
+}
+
+func gstatid2(id uint32) []byte {
+	rid := make([]byte,5)
+	rid[0] = p2_gstat
+	bin.PutUint32(rid[1:],id)
+	return rid
+}
+func recid2(id uint32, num int64) []byte {
+	rid := make([]byte,13)
+	rid[0] = p2_rec
+	bin.PutUint32(rid[1:],id)
+	bin.PutUint64(rid[5:],uint64(num))
+	return rid
+}
+
+func (f *ovf2) gstatid(grp []byte) []byte { return gstatid2(f.gid(grp)) }
+func (f *ovf2) recid(grp []byte, num int64) []byte { return recid2(f.gid(grp),num) }
+
+func (*ovf2) recid_prefix_eq(rid1, rid2 []byte) bool {
+	if len(rid1)!=13 || len(rid2)!=13 { return false }
+	return string(rid1[:5])==string(rid2[:5])
+}
+func (*ovf2) recid_incr(rid []byte) { ovf1(0).recid_incr(rid) }
+func (*ovf2) recid2num(recid []byte) int64 { return ovf1(0).recid2num(recid) }
+
+func appendVarint(rec []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(rec,b[:binary.PutVarint(b[:],v)]...)
+}
+func appendField(rec []byte, p []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	rec = append(rec,b[:binary.PutUvarint(b[:],uint64(len(p)))]...)
+	return append(rec,p...)
+}
+func splitVarint(rec []byte) (int64, []byte, error) {
+	v,n := binary.Varint(rec)
+	if n<=0 { return 0,nil,eRecShort }
+	return v,rec[n:],nil
+}
+func splitField(rec []byte) ([]byte, []byte, error) {
+	l,n := binary.Uvarint(rec)
+	if n<=0 || uint64(len(rec)-n)<l { return nil,nil,eRecShort }
+	rec = rec[n:]
+	return rec[:l],rec[l:],nil
+}
+
+func (*ovf2) explodeRecord(rec []byte, tk *storage.TOKEN, ove *storage.OverviewElement) (err error) {
+	if len(rec)<len(tk) { return eRecShort }
+	rec = rec[copy(tk[:],rec):]
+	if ove.Subject,rec,err = splitField(rec); err!=nil { return }
+	if ove.From   ,rec,err = splitField(rec); err!=nil { return }
+	if ove.Date   ,rec,err = splitField(rec); err!=nil { return }
+	if ove.MsgId  ,rec,err = splitField(rec); err!=nil { return }
+	if ove.Refs   ,rec,err = splitField(rec); err!=nil { return }
+	if ove.Lng    ,rec,err = splitVarint(rec); err!=nil { return }
+	ove.Lines,_,err = splitVarint(rec)
+	return
+}
+func (*ovf2) joinRecord(buf []byte, tk *storage.TOKEN, ove *storage.OverviewElement) (rec []byte) {
+	rec = buf[:0]
+	rec = append(rec,tk[:]...)
+	rec = appendField(rec,ove.Subject)
+	rec = appendField(rec,ove.From)
+	rec = appendField(rec,ove.Date)
+	rec = appendField(rec,ove.MsgId)
+	rec = appendField(rec,ove.Refs)
+	rec = appendVarint(rec,ove.Lng)
+	rec = appendVarint(rec,ove.Lines)
+	return
+}
+
+func (*ovf2) explodeGstat(rec []byte) (num, low, high int64, err error) {
+	if num ,rec,err = splitVarint(rec); err!=nil { return }
+	if low ,rec,err = splitVarint(rec); err!=nil { return }
+	high,_,err = splitVarint(rec)
+	return
+}
+func (*ovf2) joinGstat(buf []byte, num, low, high int64) (rec []byte) {
+	rec = buf[:0]
+	rec = appendVarint(rec,num)
+	rec = appendVarint(rec,low)
+	rec = appendVarint(rec,high)
+	return
+}
@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ovldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+Returns the number of the first record of grp with a number >= num or def,
+if there is none.
+*/
+func (ov *OvLDB) firstFrom(kf OvKeyFormat, grp []byte, num int64, def int64) int64 {
+	rng := recrange(kf,grp)
+	rng.Start = kf.recid(grp,num)
+	iter := ov.DB.NewIterator(rng,nil)
+	defer iter.Release()
+	if !iter.First() { return def }
+	return kf.recid2num(iter.Key())
+}
+
+/*
+Rescans the records of a group and rewrites its stats-record. The high
+water-mark is never lowered, so article numbers are never reused.
+*/
+func (ov *OvLDB) renumber(grp []byte) (err error) {
+	defer ov.lock_group(grp)()
+	kf,vf := ov.formats(grp)
+	
+	mrid := kf.gstatid(grp)
+	var num,low,high int64
+	
+	/* Keep the old high water-mark, if any. */
+	rec,err1 := ov.DB.Get(mrid,nil)
+	if err1==nil {
+		_,_,high,_ = vf.explodeGstat(rec)
+	}
+	
+	first := true
+	iter := ov.DB.NewIterator(recrange(kf,grp),nil)
+	for iter.Next() {
+		n := kf.recid2num(iter.Key())
+		if first { low = n; first = false }
+		if high<n { high = n }
+		num++
+	}
+	iter.Release()
+	if err = iter.Error(); err!=nil { return }
+	
+	if num==0 {
+		if err1!=nil { return err1 } /* No stats-record, no records: No group. */
+		low = high+1
+	}
+	
+	return ov.DB.Put(mrid,vf.joinGstat(make([]byte,32),num,low,high),nil)
+}
+
+/*
+Enumerates all groups, including groups, that have records but no stats-record.
+*/
+func (ov *OvLDB) allGroups() (grps [][]byte, err error) {
+	seen := make(map[string]bool)
+	add := func(grp []byte) {
+		if seen[string(grp)] { return }
+		seen[string(grp)] = true
+		grps = append(grps,append([]byte(nil),grp...))
+	}
+	
+	/* V2 groups. */
+	iter := ov.DB.NewIterator(util.BytesPrefix([]byte{p2_gid}),nil)
+	for iter.Next() { add(iter.Key()[1:]) }
+	iter.Release()
+	if err = iter.Error(); err!=nil { return }
+	
+	/* V1 groups. Skip over the records of each group. */
+	iter = ov.DB.NewIterator(&util.Range{Start: []byte{0x20}},nil)
+	defer iter.Release()
+	for ok := iter.First(); ok; {
+		key := iter.Key()
+		grp := v1group(key)
+		if grp==nil { ok = iter.Next(); continue }
+		add(grp)
+		if key[len(key)-1]==0xff && len(key)==len(grp)+1 {
+			ok = iter.Next()
+		} else {
+			ok = iter.Seek(append(append([]byte(nil),grp...),0x01))
+		}
+	}
+	err = iter.Error()
+	return
+}
+
+/*
+Rescans the Overview lines of a group and repairs its count/low/high stats-record.
+If grp is nil, all groups are renumbered.
+*/
+func (ov *OvLDB) RenumberGroup(grp []byte) (err error) {
+	if grp!=nil { return ov.renumber(grp) }
+	
+	grps,err := ov.allGroups()
+	if err!=nil { return }
+	for _,grp := range grps {
+		err = ov.renumber(grp)
+		if err!=nil { return }
+	}
+	return
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package rildb
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"encoding/binary"
+	"errors"
+)
+
+var eRecShort = errors.New("rildb: record too short")
+var eRecVersion = errors.New("rildb: unsupported record version")
+
+/*
+Key prefixes.
+*/
+const (
+	p_meta = 0x00
+	p_msg  = 'M' // 'M' <message-id> -> record
+	p_time = 'T' // 'T' <expires> <hash> -> message-id
+)
+
+var k_version = []byte{p_meta,'v','e','r'}
+
+// The current database format.
+const Version_1 = 1
+
+/*
+The record format (version 1):
+
+	<version:1> <len(timekey):uvarint> <timekey> { <len(group):uvarint> <group> <num:varint> }
+
+The timekey is the key of the corresponding entry in the time index (without
+prefix), or empty, if the article does not expire.
+*/
+const recV1 = 1
+
+func mkey(msgid []byte) []byte {
+	k := make([]byte,len(msgid)+1)
+	k[0] = p_msg
+	copy(k[1:],msgid)
+	return k
+}
+func tkey(tn []byte) []byte {
+	k := make([]byte,len(tn)+1)
+	k[0] = p_time
+	copy(k[1:],tn)
+	return k
+}
+
+func appendUvarint(rec []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(rec,b[:binary.PutUvarint(b[:],v)]...)
+}
+func appendVarint(rec []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(rec,b[:binary.PutVarint(b[:],v)]...)
+}
+func splitField(rec []byte) ([]byte, []byte, error) {
+	l,n := binary.Uvarint(rec)
+	if n<=0 || uint64(len(rec)-n)<l { return nil,nil,eRecShort }
+	rec = rec[n:]
+	return rec[:l],rec[l:],nil
+}
+
+func recBegin(buf []byte, tn []byte) []byte {
+	rec := append(buf[:0],recV1)
+	rec = appendUvarint(rec,uint64(len(tn)))
+	return append(rec,tn...)
+}
+func recAppend(rec []byte, rie *storage.RiElement) []byte {
+	rec = appendUvarint(rec,uint64(len(rie.Group)))
+	rec = append(rec,rie.Group...)
+	return appendVarint(rec,rie.Num)
+}
+
+/*
+Splits a record into the timekey and the group/number-pairs.
+*/
+func recSplit(rec []byte) (tn []byte, pairs []byte, err error) {
+	if len(rec)<1 { return nil,nil,eRecShort }
+	if rec[0]!=recV1 { return nil,nil,eRecVersion }
+	return splitField(rec[1:])
+}
+
+/*
+Decodes the next group/number-pair.
+*/
+func recNext(pairs []byte, rie *storage.RiElement) (rest []byte, err error) {
+	var grp []byte
+	grp,pairs,err = splitField(pairs)
+	if err!=nil { return }
+	num,n := binary.Varint(pairs)
+	if n<=0 { return nil,eRecShort }
+	rie.Group = grp
+	rie.Num = num
+	return pairs[n:],nil
+}
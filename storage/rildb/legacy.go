@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package rildb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	
+	"fmt"
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+/*
+The legacy layout used three databases and a text format:
+
+	rildbm: <message-id> -> "<group> <num>\n"...
+	rildbt: <expires> <hash> -> <message-id>
+	rildbr: <message-id> -> <expires> <hash>
+*/
+var legacyNames = []string{"rildbm","rildbt","rildbr"}
+
+func exists(name string) bool {
+	_,err := os.Stat(name)
+	return err==nil
+}
+
+/*
+Imports the legacy databases from the spool, if present. The import is
+idempotent; once it succeeded, the legacy databases are renamed to "*.old".
+*/
+func (r *RiLDB) importLegacy(spool string, o *opt.Options) (err error) {
+	mpath := filepath.Join(spool,"rildbm")
+	rpath := filepath.Join(spool,"rildbr")
+	if !exists(mpath) { return }
+	
+	mdb,err := leveldb.OpenFile(mpath,o)
+	if err!=nil { return }
+	
+	var rdb *leveldb.DB
+	if exists(rpath) {
+		rdb,err = leveldb.OpenFile(rpath,o)
+		if err!=nil { mdb.Close(); return }
+	}
+	
+	err = r.importLegacyDBs(mdb,rdb)
+	mdb.Close()
+	if rdb!=nil { rdb.Close() }
+	if err!=nil { return }
+	
+	for _,name := range legacyNames {
+		pth := filepath.Join(spool,name)
+		if !exists(pth) { continue }
+		err = os.Rename(pth,pth+".old")
+		if err!=nil { return }
+	}
+	return
+}
+
+func (r *RiLDB) importLegacyDBs(mdb, rdb *leveldb.DB) (err error) {
+	bat := new(leveldb.Batch)
+	var rec []byte
+	rie := new(storage.RiElement)
+	iter := mdb.NewIterator(nil,nil)
+	for iter.Next() {
+		msgid := iter.Key()
+		var tn []byte
+		if rdb!=nil { tn,_ = rdb.Get(msgid,nil) }
+		
+		rec = recBegin(rec,tn)
+		buf := bytes.NewBuffer(iter.Value())
+		for {
+			var g string
+			var n int64
+			p,_ := fmt.Fscanln(buf,&g,&n)
+			if p==0 { break }
+			if p!=2 { continue }
+			*rie = storage.RiElement{Group:[]byte(g),Num:n}
+			rec = recAppend(rec,rie)
+		}
+		
+		bat.Put(mkey(msgid),rec)
+		if len(tn)!=0 { bat.Put(tkey(tn),msgid) }
+		if bat.Len()>=1<<10 {
+			err = r.DB.Write(bat,nil)
+			if err!=nil { iter.Release(); return }
+			bat.Reset()
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err!=nil { return }
+	return r.DB.Write(bat,nil)
+}
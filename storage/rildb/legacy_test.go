@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+package rildb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type legacyArticle struct {
+	msgid   string
+	expires time.Time
+	pairs   []storage.RiElement
+}
+
+// Writes the articles into the three legacy databases, as the old RiLDB did.
+func writeLegacy(t *testing.T, spool string, arts []legacyArticle) {
+	var dbs [3]*leveldb.DB
+	for i,name := range legacyNames {
+		db,err := leveldb.OpenFile(filepath.Join(spool,name),nil)
+		if err!=nil { t.Fatal(err) }
+		defer db.Close()
+		dbs[i] = db
+	}
+	mdb,tdb,rdb := dbs[0],dbs[1],dbs[2]
+	for _,a := range arts {
+		msgid := []byte(a.msgid)
+		if !a.expires.IsZero() {
+			tn := timekey(&storage.Article_MD{Expires: a.expires},msgid)
+			tdb.Put(tn,msgid,nil)
+			rdb.Put(msgid,tn,nil)
+		}
+		var rec []byte
+		for _,p := range a.pairs { rec = append(rec,fmt.Sprintln(string(p.Group),p.Num)...) }
+		mdb.Put(msgid,rec,nil)
+	}
+}
+
+func checkLookupAll(t *testing.T, r *RiLDB, a legacyArticle) {
+	rie := new(storage.RiElement)
+	cur,err := r.RiLookupAll([]byte(a.msgid),rie)
+	if err!=nil { t.Fatalf("%s: %v",a.msgid,err) }
+	defer cur.Release()
+	i := 0
+	for ; cur.Next(); i++ {
+		if i>=len(a.pairs) || string(rie.Group)!=string(a.pairs[i].Group) || rie.Num!=a.pairs[i].Num {
+			t.Errorf("%s: unexpected pair %s %d",a.msgid,rie.Group,rie.Num)
+			return
+		}
+	}
+	if i!=len(a.pairs) { t.Errorf("%s: %d pairs, expected %d",a.msgid,i,len(a.pairs)) }
+}
+
+// Returns the history entries of RiQueryExpiredRange as strings.
+func queryRange(t *testing.T, r *RiLDB, from, to *time.Time) (res []string) {
+	rih := new(storage.RiHistory)
+	cur,err := r.RiQueryExpiredRange(from,to,nil,rih)
+	if err!=nil { t.Fatal(err) }
+	defer cur.Release()
+	for cur.Next() {
+		if rih.Group!=nil {
+			res = append(res,fmt.Sprintf("%s:%d",rih.Group,rih.Num))
+		} else {
+			res = append(res,string(rih.MessageId))
+		}
+	}
+	return
+}
+
+func TestImportLegacy(t *testing.T) {
+	spool,err := ioutil.TempDir("","rildb-test")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(spool)
+	
+	t0 := time.Date(2020,1,1,0,0,0,0,time.UTC)
+	arts := []legacyArticle{
+		{"<a@example.org>",t0.Add(time.Hour),[]storage.RiElement{{Group: []byte("test.a"), Num: 1},{Group: []byte("test.b"), Num: 7}}},
+		{"<b@example.org>",t0.Add(2*time.Hour),[]storage.RiElement{{Group: []byte("test.a"), Num: 2}}},
+		{"<c@example.org>",time.Time{},[]storage.RiElement{{Group: []byte("test.c"), Num: 3}}},
+	}
+	writeLegacy(t,spool,arts)
+	
+	r,err := OpenSpoolRiLDB(spool,nil)
+	if err!=nil { t.Fatal(err) }
+	for _,a := range arts { checkLookupAll(t,r,a) }
+	
+	to := t0.Add(90*time.Minute)
+	if res := fmt.Sprint(queryRange(t,r,nil,&to)); res!="[test.a:1 test.b:7 <a@example.org>]" { t.Errorf("query up to %v: %s",to,res) }
+	if res := fmt.Sprint(queryRange(t,r,nil,nil)); res!="[test.a:1 test.b:7 <a@example.org> test.a:2 <b@example.org>]" { t.Errorf("query: %s",res) }
+	r.DB.Close()
+	
+	for _,name := range legacyNames {
+		if _,err := os.Stat(filepath.Join(spool,name)); !os.IsNotExist(err) { t.Errorf("%s: not renamed",name) }
+		if _,err := os.Stat(filepath.Join(spool,name+".old")); err!=nil { t.Errorf("%s.old: %v",name,err) }
+	}
+	
+	/* Reopening must not import again. */
+	r,err = OpenSpoolRiLDB(spool,nil)
+	if err!=nil { t.Fatal(err) }
+	defer r.DB.Close()
+	for _,a := range arts { checkLookupAll(t,r,a) }
+}
@@ -22,6 +22,9 @@ SOFTWARE.
 
 /*
 Stores reverse index data into a LevelDB database.
+
+The message-id index and the time index share one database, so every
+update is a single atomic batch.
 */
 package rildb
 
@@ -29,66 +32,65 @@ package rildb
 import (
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
-	//"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	
 	"github.com/byte-mug/fastnntp-backend2/storage"
-	//"github.com/byte-mug/fastnntp-backend2/utils/minihash"
-	//"sync"
-	//"io"
-	//"errors"
 	
 	"fmt"
 	"path/filepath"
 	"hash/fnv"
-	"bytes"
 	"time"
 )
 
 const tfnano = "20060102150405"
 
 type RiLDB struct{
-	MDB *leveldb.DB
-	TDB *leveldb.DB
-	RDB *leveldb.DB
+	DB *leveldb.DB
 }
 
+var _ storage.RiMethod = (*RiLDB)(nil)
+
 
 type riLDBWriter struct{
 	*RiLDB
 	msgid []byte
-	buf *bytes.Buffer
+	rec   []byte
+	tn    []byte
+}
+
+func timekey(md *storage.Article_MD, msgid []byte) []byte {
+	ha := fnv.New64a()
+	ha.Write(msgid)
+	tn := make([]byte,0,len(tfnano)+8)
+	tn = md.Expires.AppendFormat(tn,tfnano)
+	return ha.Sum(tn)
 }
 
 // Called for the first group/number-pair associated to the article
 func(r *riLDBWriter) RiWrite(md *storage.Article_MD, rie *storage.RiElement) (err error) {
-	msgid := r.msgid
 	if !md.Expires.IsZero() {
-		ha := fnv.New64a()
-		ha.Write(msgid)
-		tn := make([]byte,0,len(tfnano)+8)
-		tn = md.Expires.AppendFormat(tn,tfnano)
-		tn = ha.Sum(tn)
-		err = r.TDB.Put(tn,msgid,nil)
-		if err!=nil { return }
-		r.RDB.Put(msgid,tn,nil)
-		if err!=nil { return }
+		r.tn = timekey(md,r.msgid)
 	}
-	fmt.Fprintln(r.buf,string(rie.Group),rie.Num)
+	r.rec = recBegin(r.rec,r.tn)
+	r.rec = recAppend(r.rec,rie)
 	return
 }
 
 // Called for the remaining group/number-pair associated to the article
 func(r *riLDBWriter) RiWriteMore(md *storage.Article_MD, rie *storage.RiElement) (err error) {
-	fmt.Fprintln(r.buf,string(rie.Group),rie.Num)
+	if r.rec==nil { return r.RiWrite(md,rie) }
+	r.rec = recAppend(r.rec,rie)
 	return
 }
 
 // Called at after all group/number-pair have been associated.
 func(r *riLDBWriter) RiCommit() (err error) {
-	msgid, buf := r.msgid, r.buf
-	
-	err = r.MDB.Put(msgid,buf.Bytes(),nil)
+	if r.rec==nil { return }
+	bat := new(leveldb.Batch)
+	bat.Put(mkey(r.msgid),r.rec)
+	if len(r.tn)!=0 { bat.Put(tkey(r.tn),r.msgid) }
+	err = r.DB.Write(bat,nil)
 	return
 }
 
@@ -106,22 +108,16 @@ var relinst storage.Releaser = relobj(0)
 
 // Performs a reverse index lookup: message-id to the first group/number pair.
 func(r *RiLDB) RiLookup(msgid []byte,rie *storage.RiElement) (rel storage.Releaser,err error) {
-	var rec []byte
-	
-	rec,err = r.MDB.Get(msgid,nil)
+	var rec,pairs []byte
 	
+	rec,err = r.DB.Get(mkey(msgid),nil)
 	if err!=nil { return }
 	
-	buf := bytes.NewBuffer(rec)
-	
-	var g string
-	var n int64
-	_,err = fmt.Fscanln(buf,&g,&n)
-	
+	_,pairs,err = recSplit(rec)
 	if err!=nil { return }
 	
-	rie.Group = []byte(g)
-	rie.Num = n
+	_,err = recNext(pairs,rie)
+	if err!=nil { return }
 	
 	rel = relinst
 	
@@ -130,55 +126,39 @@ func(r *RiLDB) RiLookup(msgid []byte,rie *storage.RiElement) (rel storage.Releas
 
 
 type cursorLM struct{
-	rie  *storage.RiElement
-	mdb  *leveldb.DB
-	buf  *bytes.Buffer
+	rie   *storage.RiElement
+	pairs []byte
 }
 
 func (c *cursorLM) Release() {}
-func (c *cursorLM) refill(key []byte) (error) {
-	val,err := c.mdb.Get(key,nil)
-	c.buf = bytes.NewBuffer(val)
-	return err
-}
 
 func (c *cursorLM) Next() (ok bool) {
-	if c.buf==nil { return }
-	restart:
-	if c.buf==nil { return }
-	var g string
-	var n int64
-	p,_ := fmt.Fscanln(c.buf,&g,&n)
-	switch p {
-	case 0,2:
-		ok = p==2
-	case 1:
-		goto restart
-	}
-	if ok {
-		*c.rie = storage.RiElement{Group:[]byte(g),Num:n}
-		return
-	}
-	return
+	if len(c.pairs)==0 { return }
+	var err error
+	c.pairs,err = recNext(c.pairs,c.rie)
+	return err==nil
 }
 
 // Performs a reverse index lookup: message-id to all first group/number pairs.
 func(r *RiLDB) RiLookupAll(msgid []byte,rie *storage.RiElement) (rel storage.Cursor,err error) {
-	cur := &cursorLM{rie,r.MDB,nil}
-	err = cur.refill(msgid)
-	if err==nil { rel = cur }
+	var rec,pairs []byte
+	rec,err = r.DB.Get(mkey(msgid),nil)
+	if err==nil { _,pairs,err = recSplit(rec) }
+	if err==nil { rel = &cursorLM{rie,pairs} }
 	return
 }
 
 
 type cursor struct{
-	iter iterator.Iterator
-	rih  *storage.RiHistory
-	mdb  *leveldb.DB
-	next bool
-	buf  *bytes.Buffer
-	key  []byte
-	barrier []byte
+	iter   iterator.Iterator
+	rih    *storage.RiHistory
+	db     *leveldb.DB
+	next   bool
+	rie    storage.RiElement
+	pairs  []byte
+	key    []byte
+	haskey bool
+	tn     []byte
 }
 
 func (c *cursor) Release() { c.iter.Release() }
@@ -190,85 +170,128 @@ func (c *cursor) refill() (ok bool) {
 		c.next = true
 	}
 	if ok {
-		if string(c.iter.Key())>string(c.barrier) { return false }
-		c.key = c.iter.Value()
-		val,_ := c.mdb.Get(c.key,nil)
-		c.buf = bytes.NewBuffer(val)
+		c.key = append(c.key[:0],c.iter.Value()...)
+		c.tn = append(c.tn[:0],c.iter.Key()[1:]...)
+		c.haskey = true
+		c.pairs = nil
+		rec,err := c.db.Get(mkey(c.key),nil)
+		if err==nil { _,c.pairs,_ = recSplit(rec) }
 	}
 	return
 }
 func (c *cursor) Next() (ok bool) {
-	if c.buf==nil {
+	for {
+		if len(c.pairs)!=0 {
+			var err error
+			c.pairs,err = recNext(c.pairs,&c.rie)
+			if err==nil {
+				*c.rih = storage.RiHistory{Group:c.rie.Group,Num:c.rie.Num}
+				return true
+			}
+			c.pairs = nil
+		}
+		if c.haskey {
+			*c.rih = storage.RiHistory{MessageId:c.key}
+			c.haskey = false
+			return true
+		}
 		if !c.refill() { return } /* End of it. */
 	}
-	restart:
-	if c.buf==nil { return }
-	var g string
-	var n int64
-	p,_ := fmt.Fscanln(c.buf,&g,&n)
-	switch p {
-	case 0,2:
-		ok = p==2
-	case 1:
-		goto restart
-	}
-	if ok {
-		*c.rih = storage.RiHistory{Group:[]byte(g),Num:n}
-		return
-	}
-	if c.key!=nil {
-		*c.rih = storage.RiHistory{MessageId:c.key}
-		c.key = nil
-		return true
-	}
-	if c.refill() { goto restart }
-	return
+}
+func (c *cursor) Continuation() []byte {
+	return append([]byte(nil),c.tn...)
 }
 
 
 // Query Expired articles. SHOULD return message-ids after their group/number counterparts.
 func(r *RiLDB) RiQueryExpired(ow *time.Time, rih *storage.RiHistory) (cur storage.Cursor, err error) {
-	lid := make([]byte,0,len(tfnano)+8)
-	lid = ow.AppendFormat(lid,tfnano)
-	lid = append(lid,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff)
+	to := ow.Add(time.Second)
+	return r.RiQueryExpiredRange(nil,&to,nil,rih)
+}
+
+// Query articles, that expire within [from,to). from and to may be nil (unbounded).
+// If cont is not nil, the query resumes after the article, the continuation key was obtained from.
+func(r *RiLDB) RiQueryExpiredRange(from, to *time.Time, cont []byte, rih *storage.RiHistory) (cur storage.ExpiryCursor, err error) {
+	rng := &util.Range{Start: []byte{p_time}, Limit: []byte{p_time+1}}
+	if from!=nil {
+		rng.Start = tkey(from.AppendFormat(make([]byte,0,len(tfnano)),tfnano))
+	}
+	if cont!=nil {
+		start := append(tkey(cont),0x00)
+		if string(start)>string(rng.Start) { rng.Start = start }
+	}
+	if to!=nil {
+		rng.Limit = tkey(to.AppendFormat(make([]byte,0,len(tfnano)),tfnano))
+	}
 	
-	iter := r.TDB.NewIterator(nil,nil)
-	cur = &cursor{iter,rih,r.MDB,false,nil,nil,lid}
+	iter := r.DB.NewIterator(rng,nil)
+	cur = &cursor{iter:iter,rih:rih,db:r.DB}
 	return
 }
 
 // Expires an article using the message-id.
 func(r *RiLDB) RiExpire(msgid []byte) (err error) {
-	var tsid []byte
+	var rec,tn []byte
 	
-	tsid,err = r.RDB.Get(msgid,nil)
+	mk := mkey(msgid)
+	rec,err = r.DB.Get(mk,nil)
 	if err!=nil { return }
 	
-	var err2,err3 error
+	bat := new(leveldb.Batch)
+	bat.Delete(mk)
+	if tn,_,err = recSplit(rec); err==nil && len(tn)!=0 {
+		bat.Delete(tkey(tn))
+	}
 	
-	err = r.MDB.Delete(msgid,nil)
-	err2 = r.TDB.Delete(tsid,nil)
-	err3 = r.RDB.Delete(msgid,nil)
+	err = r.DB.Write(bat,nil)
+	return
+}
+
+// Replaces the group/number-pair old of an article with rie. If rie is nil, old is removed.
+func(r *RiLDB) RiReplace(msgid []byte, old, rie *storage.RiElement) (err error) {
+	var rec,tn,pairs []byte
 	
-	if err==nil { err=err2 }
-	if err==nil { err=err3 }
+	mk := mkey(msgid)
+	rec,err = r.DB.Get(mk,nil)
+	if err!=nil { return }
 	
+	tn,pairs,err = recSplit(rec)
+	if err!=nil { return }
+	
+	nrec := recBegin(make([]byte,0,len(rec)+len(old.Group)),tn)
+	var e storage.RiElement
+	for len(pairs)!=0 {
+		pairs,err = recNext(pairs,&e)
+		if err!=nil { return }
+		if string(e.Group)==string(old.Group) && e.Num==old.Num {
+			if rie==nil { continue }
+			e = *rie
+		}
+		nrec = recAppend(nrec,&e)
+	}
+	
+	err = r.DB.Put(mk,nrec,nil)
 	return
 }
 
 
 func OpenSpoolRiLDB(spool string, o *opt.Options) (*RiLDB,error) {
-	mdb,err := leveldb.OpenFile(filepath.Join(spool,"rildbm"), o)
+	db,err := leveldb.OpenFile(filepath.Join(spool,"rildb"), o)
 	if err!=nil { return nil,err }
-	tdb,err := leveldb.OpenFile(filepath.Join(spool,"rildbt"), o)
-	if err!=nil { mdb.Close(); return nil,err }
-	rdb,err := leveldb.OpenFile(filepath.Join(spool,"rildbr"), o)
-	if err!=nil { mdb.Close(); return nil,err }
-	return &RiLDB{
-		MDB: mdb, // MessageID-DB
-		TDB: tdb, // Time-DB
-		RDB: rdb, // Reverse Time-DB
-	},nil
+	r := &RiLDB{DB: db}
+	
+	ver,err := db.Get(k_version,nil)
+	if err==leveldb.ErrNotFound {
+		ver = []byte{Version_1}
+		err = db.Put(k_version,ver,nil)
+	}
+	if err==nil && (len(ver)!=1 || ver[0]!=Version_1) {
+		err = fmt.Errorf("rildb: unsupported version %x",ver)
+	}
+	if err==nil { err = r.importLegacy(spool,o) }
+	if err!=nil { db.Close(); return nil,err }
+	
+	return r,nil
 }
 
 
@@ -280,5 +303,3 @@ func loader_rildb(cfg *storage.CfgMaster) (storage.RiMethod,error) {
 func init() {
 	storage.RegisterRiLoader("rildb",loader_rildb)
 }
-
-
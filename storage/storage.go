@@ -38,6 +38,7 @@ import (
 )
 
 var ENotInitialized = errors.New("SM not Initialized")
+var ERemembered = errors.New("Message-ID remembered, but not stored")
 
 type SMFlags uint
 const (
@@ -100,6 +101,18 @@ type StorageMethod interface {
 	Cancel(t *TOKEN) (err error)
 }
 
+/*
+Optionally implemented by a StorageMethod. Enumerates the stored articles.
+*/
+type TokenWalker interface {
+	// Calls f for each article of the storage class cls. If f returns an error, the walk is aborted.
+	// The token passed to f may differ from the token returned by Store, but it addresses the same article.
+	WalkTokens(cls byte, f func(t *TOKEN, arrival time.Time) error) (err error)
+	
+	// Converts a token into a canonical form, so that tokens addressing the same article are equal.
+	Canonical(t *TOKEN)
+}
+
 type OverviewElement struct{
 	Num int64
 	Subject, From, Date, MsgId, Refs []byte
@@ -120,30 +133,87 @@ type OverviewMethod interface {
 	// Writes a new Overview line into the database.
 	GroupWriteOv(grp []byte, autonum bool, md *Article_MD, tk *TOKEN, ove *OverviewElement) (err error)
 	
+	// Writes a new Overview line into each group in one atomic operation. Either all or none of the lines are written.
+	// nums must have the same length as grps. If autonum is true, the assigned article numbers are stored into nums,
+	// otherwise nums holds the article numbers.
+	GroupWriteOvBatch(grps [][]byte, autonum bool, md *Article_MD, tk *TOKEN, ove *OverviewElement, nums []int64) (err error)
+	
+	// Assigns an article number in each group, without writing an Overview line. The numbers are stored into nums.
+	// Use GroupWriteOvBatch with autonum=false to write the lines later on.
+	GroupReserveNums(grps [][]byte, nums []int64) (err error)
+	
 	// Deletes an Overview line from the database.
 	CancelOv(grp []byte, num int64) (err error)
 	
 	// Initializes a group in the overview-database.
 	InitGroup(grp []byte) (err error)
+	
+	// Removes a group and all of its Overview lines from the database.
+	RemoveGroup(grp []byte) (err error)
+	
+	// Renames a group. The article numbers are preserved.
+	RenameGroup(oldgrp, newgrp []byte) (err error)
+	
+	// Rescans the Overview lines of a group and repairs its count/low/high water-marks.
+	// If grp is nil, all groups are renumbered.
+	RenumberGroup(grp []byte) (err error)
 }
 
 type GroupElement struct {
 	Group []byte
 	Status byte
 	Description []byte
+	
+	// If Status is '=', the group, the articles are filed into.
+	Alias []byte
 }
 type GroupMethod interface {
 	FetchGroups(status, descr bool, ge *GroupElement) (cur Cursor,err error)
 }
 
+/*
+Optionally implemented by a GroupMethod. Modifies the list of groups.
+*/
+type GroupWriter interface {
+	// Creates or updates a group. If ge.Description is nil, the description is left unchanged.
+	PutGroup(ge *GroupElement) (err error)
+	
+	// Removes a group from the list.
+	DeleteGroup(grp []byte) (err error)
+}
+
 /*
 Inspired by INN's HIS(history) database.
 Maps message-ids to storage tokens.
 */
 type HisMethod interface {
 	HisWrite(msgid []byte,md *Article_MD, t *TOKEN) (err error)
+	
+	// Returns ERemembered, if the message-id has a tombstone.
 	HisLookup(msgid []byte, t *TOKEN) (err error)
+	
+	// Like HisLookup, but also returns the arrival and expiry times, if known. md may be nil.
+	HisQuery(msgid []byte, md *Article_MD, t *TOKEN) (err error)
 	HisCancel(msgid []byte) (err error)
+	
+	// Replaces the entry with a tombstone: the message-id has been seen, but is not stored.
+	// The tombstone expires at until. If until is zero, it never expires.
+	HisRemember(msgid []byte, until time.Time) (err error)
+	
+	// Removes the tombstones, that have expired at ow.
+	HisExpireRemembered(ow time.Time) (n int64, err error)
+	
+	// Removes the entries of articles, that arrived before ow. Tombstones and
+	// entries without arrival time are kept.
+	HisPurge(ow time.Time) (n int64, err error)
+}
+
+/*
+Optionally implemented by a HisMethod. Enumerates the message-ids in the history.
+*/
+type HisWalker interface {
+	// Calls f for each message-id, including tombstones. If f returns an error, the walk is aborted.
+	HisWalk(f func(msgid []byte) error) (err error)
 }
 
 type RiElement struct{
@@ -160,6 +230,13 @@ type RiHistory struct{
 	MessageId []byte
 }
 
+type ExpiryCursor interface {
+	Cursor
+	
+	// Returns the continuation key of the last returned message-id.
+	Continuation() []byte
+}
+
 type RiWriter interface {
 	// Called for the first group/number-pair associated to the article
 	RiWrite(md *Article_MD, rie *RiElement) (err error)
@@ -188,8 +265,15 @@ type RiMethod interface {
 	// Query Expired articles. SHOULD return message-ids after their group/number counterparts.
 	RiQueryExpired(ow *time.Time, rih *RiHistory) (cur Cursor, err error)
 	
+	// Query articles, that expire within [from,to). from and to may be nil (unbounded).
+	// If cont is not nil, the query resumes after the article, the continuation key was obtained from.
+	RiQueryExpiredRange(from, to *time.Time, cont []byte, rih *RiHistory) (cur ExpiryCursor, err error)
+	
 	// Expires an article using the message-id.
 	RiExpire(msgid []byte) (err error)
+	
+	// Replaces the group/number-pair old of an article with rie. If rie is nil, old is removed.
+	RiReplace(msgid []byte, old, rie *RiElement) (err error)
 }
 
 type CfgBaseInfo struct{
@@ -45,6 +45,7 @@ import (
 	"fmt"
 	"encoding/binary"
 	"sync/atomic"
+	"time"
 )
 
 func str2os(s string) string {
@@ -120,6 +121,46 @@ func (sm *TimeHashSpool) Cancel(t *storage.TOKEN) (err error) {
 }
 
 var _ storage.StorageMethod = (*TimeHashSpool)(nil)
+var _ storage.TokenWalker = (*TimeHashSpool)(nil)
+
+// Only the lower 16 bits of the serial number are part of the file name.
+func (sm *TimeHashSpool) Canonical(t *storage.TOKEN) {
+	b := t.Bytes()
+	b[8],b[9] = 0,0
+	storage.Bzero(b[12:])
+}
+
+// Parses "zzbb/cc/yyyy-aadd" back into a token.
+func thparse(cls byte, rel string, t *storage.TOKEN) bool {
+	var zz,bb,cc,yyyy,aa,dd uint64
+	n,err := fmt.Sscanf(rel,"%02x%02x/%02x/%04x-%02x%02x",&zz,&bb,&cc,&yyyy,&aa,&dd)
+	if err!=nil || n!=6 || len(rel)!=17 { return false }
+	tm := zz<<32|aa<<24|bb<<16|cc<<8|dd
+	t[0] = cls
+	t[1] = 0
+	b := t.Bytes()
+	storage.Bzero(b)
+	bin.PutUint64(b,tm)
+	bin.PutUint32(b[8:],uint32(yyyy))
+	return true
+}
+
+func (sm *TimeHashSpool) WalkTokens(cls byte, f func(t *storage.TOKEN, arrival time.Time) error) (err error) {
+	root := filepath.Join(sm.SpoolPath,fmt.Sprintf("time-%02x",cls))
+	t := new(storage.TOKEN)
+	err = filepath.Walk(root,func(path string, info os.FileInfo, err error) error {
+		if err!=nil {
+			if path==root && os.IsNotExist(err) { return filepath.SkipDir }
+			return err
+		}
+		if info.IsDir() { return nil }
+		rel,err := filepath.Rel(root,path)
+		if err!=nil { return err }
+		if !thparse(cls,filepath.ToSlash(rel),t) { return nil } /* Not an article (eg. a .del file). */
+		return f(t,time.Unix(int64(bin.Uint64(t.Bytes())),0))
+	})
+	return
+}
 
 type articleFile struct {
 	*os.File
@@ -41,9 +41,10 @@ import (
 	"bufio"
 	"regexp"
 	"fmt"
+	"sync"
 )
 
-var line_active     = regexp.MustCompile(`^(\S+)\s+\S+\s+\S+\s+(.)`)
+var line_active     = regexp.MustCompile(`^(\S+)\s+\S+\s+\S+\s+(\S+)`)
 var line_newsgroups = regexp.MustCompile(`^(\S+)\s+(.*)`)
 
 var eNotSupported = errors.New("tradgroup: not supported: status&&desc")
@@ -52,6 +53,8 @@ var eNoDecompress = errors.New("decompression not supported")
 type TradGroup struct {
 	ConfigPath string // path to the folder containing "active" and "newsgroups"
 	Decompress string // must be "", ".gz", or ".bz2"
+	
+	mu sync.Mutex // serializes writers
 }
 
 var _ storage.GroupMethod = (*TradGroup)(nil)
@@ -92,6 +95,8 @@ restart:
 		if len(sm)==0 { goto restart } // Bad line! skip.
 		la.ge.Group = sm[1]
 		la.ge.Status = sm[2][0]
+		la.ge.Alias = nil
+		if la.ge.Status=='=' { la.ge.Alias = sm[2][1:] }
 	}
 	return true
 }
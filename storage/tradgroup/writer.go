@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package tradgroup
+
+import (
+	"github.com/byte-mug/fastnntp-backend2/storage"
+	"os"
+	"io/ioutil"
+	"path/filepath"
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var eCompressed = errors.New("tradgroup: compressed files are read-only")
+
+var _ storage.GroupWriter = (*TradGroup)(nil)
+
+/*
+Rewrites the file name. f receives the lines (without line-endings) and returns the new lines.
+A missing file is treated as empty.
+*/
+func (tg *TradGroup) rewrite(name string, f func(lines [][]byte) [][]byte) (err error) {
+	if tg.Decompress!="" { return eCompressed }
+	pth := filepath.Join(tg.ConfigPath,name)
+	data,err := ioutil.ReadFile(pth)
+	if err!=nil && !os.IsNotExist(err) { return }
+	
+	var lines [][]byte
+	for _,line := range bytes.Split(data,[]byte("\n")) {
+		line = bytes.TrimRight(line,"\r")
+		if len(line)!=0 { lines = append(lines,line) }
+	}
+	lines = f(lines)
+	
+	var buf bytes.Buffer
+	for _,line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := pth+".tmp"
+	err = ioutil.WriteFile(tmp,buf.Bytes(),0644)
+	if err==nil { err = os.Rename(tmp,pth) }
+	return
+}
+
+// Reports, whether line describes the group grp.
+func isGroup(line, grp []byte) bool {
+	f := bytes.Fields(line)
+	return len(f)>0 && bytes.Equal(f[0],grp)
+}
+
+// Replaces (or appends, if missing) the line of group grp. If repl is nil, the line is removed.
+func replace(lines [][]byte, grp, repl []byte) [][]byte {
+	r := lines[:0]
+	done := false
+	for _,line := range lines {
+		if isGroup(line,grp) {
+			if done || repl==nil { continue }
+			line = repl
+			done = true
+		}
+		r = append(r,line)
+	}
+	if !done && repl!=nil { r = append(r,repl) }
+	return r
+}
+
+func (tg *TradGroup) PutGroup(ge *storage.GroupElement) (err error) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	
+	status := []byte{ge.Status}
+	if ge.Status=='=' { status = append(status,ge.Alias...) }
+	err = tg.rewrite("active",func(lines [][]byte) [][]byte {
+		repl := []byte(fmt.Sprintf("%s 0000000000 0000000001 %s",ge.Group,status))
+		for _,line := range lines {
+			/* Keep the water-marks of an existing group. */
+			if f := bytes.Fields(line); len(f)>=4 && bytes.Equal(f[0],ge.Group) {
+				repl = []byte(fmt.Sprintf("%s %s %s %s",ge.Group,f[1],f[2],status))
+			}
+		}
+		return replace(lines,ge.Group,repl)
+	})
+	if err!=nil || ge.Description==nil { return }
+	
+	err = tg.rewrite("newsgroups",func(lines [][]byte) [][]byte {
+		return replace(lines,ge.Group,[]byte(fmt.Sprintf("%s\t%s",ge.Group,ge.Description)))
+	})
+	return
+}
+
+func (tg *TradGroup) DeleteGroup(grp []byte) (err error) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	
+	err = tg.rewrite("active",func(lines [][]byte) [][]byte { return replace(lines,grp,nil) })
+	if err!=nil { return }
+	err = tg.rewrite("newsgroups",func(lines [][]byte) [][]byte { return replace(lines,grp,nil) })
+	return
+}
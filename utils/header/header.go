@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+Minimalistic RFC-822 style header parsing.
+
+The functions operate on a raw header block, as produced by iohelper.Splitter.
+Folded header lines are unfolded.
+*/
+package header
+
+import "bytes"
+
+func trimWS(p []byte) []byte {
+	return bytes.Trim(p," \t\r\n")
+}
+
+func unfold(p []byte) []byte {
+	if bytes.IndexByte(p,'\n')<0 { return p }
+	r := make([]byte,0,len(p))
+	for _,b := range p {
+		if b=='\r' || b=='\n' { continue }
+		r = append(r,b)
+	}
+	return r
+}
+
+/*
+Splits off the first header field, including continuation lines.
+*/
+func next(head []byte) (line, rest []byte) {
+	end := 0
+	for {
+		i := bytes.IndexByte(head[end:],'\n')
+		if i<0 { end = len(head); break }
+		end += i+1
+		if end>=len(head) { break }
+		if head[end]!=' ' && head[end]!='\t' { break }
+	}
+	return head[:end],head[end:]
+}
+
+/*
+Calls f for each header field in head, in order. If f returns false, the
+iteration stops.
+*/
+func ForEach(head []byte, f func(name, value []byte) bool) {
+	var line []byte
+	for len(head)>0 {
+		line,head = next(head)
+		
+		i := bytes.IndexByte(line,':')
+		if i<=0 { continue } /* Bad line! skip. */
+		if !f(trimWS(line[:i]),unfold(trimWS(line[i+1:]))) { return }
+	}
+}
+
+/*
+Returns a copy of head without the header fields named name.
+*/
+func Remove(head []byte, name []byte) []byte {
+	r := make([]byte,0,len(head))
+	var line []byte
+	for len(head)>0 {
+		line,head = next(head)
+		if i := bytes.IndexByte(line,':'); i>0 && bytes.EqualFold(trimWS(line[:i]),name) { continue }
+		r = append(r,line...)
+	}
+	return r
+}
+
+/*
+Returns the (unfolded) value of the first header field named name or nil,
+if no such field exists. The comparison is case-insensitive.
+*/
+func Get(head []byte, name []byte) (value []byte) {
+	ForEach(head,func(n, v []byte) bool {
+		if !bytes.EqualFold(n,name) { return true }
+		value = v
+		if value==nil { value = []byte{} }
+		return false
+	})
+	return
+}
+
+/*
+Returns the (unfolded) values of all header fields named name.
+*/
+func GetAll(head []byte, name []byte) (values [][]byte) {
+	ForEach(head,func(n, v []byte) bool {
+		if bytes.EqualFold(n,name) { values = append(values,v) }
+		return true
+	})
+	return
+}